@@ -0,0 +1,448 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/meistens/api_practice/internal/data"
+	"github.com/meistens/api_practice/internal/validator"
+)
+
+// how long the token sent with an admin-forced password reset lasts, longer
+// than a self-service one since the user didn't ask for it
+const forcedPassResetTTL = 24 * time.Hour
+
+// look up the user named by the :id parameter, sending the error response
+// itself and returning nil if there isn't one
+func (app *application) readUser(w http.ResponseWriter, r *http.Request) *data.User {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return user
+}
+
+// revoke every token and session a user has, signed access tokens
+// included, they have to log in again
+func (app *application) revokeAllTokens(userID int64) error {
+	err := app.models.Tokens.DeleteAllScopesForUser(userID)
+	if err != nil {
+		return err
+	}
+	err = app.models.Sessions.DeleteAllForUser(userID)
+	if err != nil {
+		return err
+	}
+	return app.revokeSignedTokensForUser(userID)
+}
+
+// GET /v1/admin/users
+// search and page through users, q matches part of the name or email
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Search    string
+		Activated *bool
+		Suspended *bool
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Search = app.readString(qs, "q", "")
+	input.Activated = app.readBool(qs, "activated", v)
+	input.Suspended = app.readBool(qs, "suspended", v)
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(input.Search, input.Activated, input.Suspended, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// GET /v1/admin/users/:id
+// a user along with their roles and every permission code they hold,
+// directly or through a role
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUser(w, r)
+	if user == nil {
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllUserPerms(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user, "roles": roles, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// PUT /v1/admin/users/:id/activated
+// activate a user without the activation token
+func (app *application) adminActivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	app.setUserActivated(w, r, true)
+}
+
+// DELETE /v1/admin/users/:id/activated
+// deactivate a user, they keep their tokens but lose anything which needs
+// an activated account
+func (app *application) adminDeactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	app.setUserActivated(w, r, false)
+}
+
+func (app *application) setUserActivated(w http.ResponseWriter, r *http.Request, activated bool) {
+	user := app.readUser(w, r)
+	if user == nil {
+		return
+	}
+
+	if !activated && user.ID == app.contextGetUser(r).ID {
+		app.badRequestResponse(w, r, errors.New("you can't deactivate your own account"))
+		return
+	}
+
+	if user.Activated != activated {
+		user.Activated = activated
+
+		err := app.models.Users.Update(user)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		// their signed tokens carry the old activation status
+		err = app.revokeSignedTokensForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		eventType := data.EventAccountDeactivated
+		if activated {
+			eventType = data.EventAccountActivated
+		}
+		app.recordSecurityEvent(r, eventType, user.ID, nil)
+	}
+
+	// an outstanding activation token is no use either way now
+	err := app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo("user activation changed by admin", map[string]string{
+		"user_id":   strconv.FormatInt(user.ID, 10),
+		"admin_id":  strconv.FormatInt(app.contextGetUser(r).ID, 10),
+		"activated": strconv.FormatBool(activated),
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// POST /v1/admin/users/:id/password-reset
+// force a password reset, the current password stops working, the user is
+// logged out everywhere and emailed a token to set a new one
+func (app *application) forcePassResetHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUser(w, r)
+	if user == nil {
+		return
+	}
+
+	// service accounts have no usable password to reset
+	if user.ServiceAccount {
+		app.badRequestResponse(w, r, errors.New("service accounts don't use passwords"))
+		return
+	}
+
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = user.Password.Set(base64.RawURLEncoding.EncodeToString(randomBytes))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.revokeAllTokens(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, forcedPassResetTTL, data.ScoprPassReset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		data := map[string]any{
+			"passwordResetToken": token.Plaintext,
+		}
+
+		err := app.mailer.Send(user.Email, "token_forced_password_reset.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	app.logger.PrintInfo("password reset forced by admin", map[string]string{
+		"user_id":  strconv.FormatInt(user.ID, 10),
+		"admin_id": strconv.FormatInt(app.contextGetUser(r).ID, 10),
+	})
+	app.recordSecurityEvent(r, data.EventPasswordResetForced, user.ID, nil)
+
+	env := envelope{"message": "the user's password has been reset and they will be emailed instructions to set a new one"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// PUT /v1/admin/users/:id/permissions/:code
+// grant a permission directly, granting one the user already holds does
+// nothing, a code starting with - denies it instead
+func (app *application) grantPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	app.changePermission(w, r, true)
+}
+
+// DELETE /v1/admin/users/:id/permissions/:code
+// revoke a directly granted permission, the user keeps it if one of their
+// roles has it
+func (app *application) revokePermissionHandler(w http.ResponseWriter, r *http.Request) {
+	app.changePermission(w, r, false)
+}
+
+func (app *application) changePermission(w http.ResponseWriter, r *http.Request, grant bool) {
+	user := app.readUser(w, r)
+	if user == nil {
+		return
+	}
+
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !known.Defines(code) {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// users:admin alone would otherwise be enough to hand anyone, the admin
+	// included, every other permission
+	actor, err := app.userPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !actor.CanDelegate(code) {
+		app.cannotDelegateResponse(w, r, code)
+		return
+	}
+
+	// admins can't lock themselves out of the admin API, which a deny entry
+	// or revoking a wildcard could do too
+	if user.ID == app.contextGetUser(r).ID {
+		held, err := app.models.Permissions.GetAllUserPerms(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if grant {
+			held = append(held, code)
+		} else {
+			held = held.Without(code)
+		}
+		if !held.Include("users:admin") {
+			app.badRequestResponse(w, r, errors.New("you can't take your own users:admin permission away"))
+			return
+		}
+	}
+
+	if grant {
+		err = app.models.Permissions.AddForUser(user.ID, code)
+	} else {
+		err = app.models.Permissions.RemoveForUser(user.ID, code)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// their signed tokens carry the permissions they had before
+	err = app.revokeSignedTokensForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo("user permissions changed by admin", map[string]string{
+		"user_id":    strconv.FormatInt(user.ID, 10),
+		"admin_id":   strconv.FormatInt(app.contextGetUser(r).ID, 10),
+		"permission": code,
+		"granted":    strconv.FormatBool(grant),
+	})
+
+	eventType := data.EventPermissionRevoked
+	if grant {
+		eventType = data.EventPermissionGranted
+	}
+	app.recordSecurityEvent(r, eventType, user.ID, map[string]string{"permission": code})
+
+	permissions, err := app.models.Permissions.GetAllUserPerms(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// PUT /v1/admin/users/:id/suspended
+// suspend a user, every token they have is revoked and they can't log in
+// or use API keys until the suspension is lifted
+func (app *application) suspendUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUser(w, r)
+	if user == nil {
+		return
+	}
+
+	if user.ID == app.contextGetUser(r).ID {
+		app.badRequestResponse(w, r, errors.New("you can't suspend your own account"))
+		return
+	}
+
+	if !user.IsSuspended() {
+		err := app.models.Users.Suspend(user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// done even if they were already suspended, in case anything was
+	// issued in between
+	err := app.revokeAllTokens(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo("user suspended by admin", map[string]string{
+		"user_id":  strconv.FormatInt(user.ID, 10),
+		"admin_id": strconv.FormatInt(app.contextGetUser(r).ID, 10),
+	})
+	app.recordSecurityEvent(r, data.EventAccountSuspended, user.ID, nil)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// DELETE /v1/admin/users/:id/suspended
+// lift a suspension, the user has to log in again
+func (app *application) unsuspendUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUser(w, r)
+	if user == nil {
+		return
+	}
+
+	err := app.models.Users.Unsuspend(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo("user suspension lifted by admin", map[string]string{
+		"user_id":  strconv.FormatInt(user.ID, 10),
+		"admin_id": strconv.FormatInt(app.contextGetUser(r).ID, 10),
+	})
+	app.recordSecurityEvent(r, data.EventAccountUnsuspended, user.ID, nil)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
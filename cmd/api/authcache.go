@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/meistens/api_practice/internal/data"
+)
+
+// how often the cache listener checks its connection is still alive, a
+// dead one is only noticed when something is sent over it
+const authCacheListenerPing = 90 * time.Second
+
+// start a background goroutine which applies the cache invalidations
+// other instances send through postgres, it stops when ctx is cancelled
+// does nothing when the cache is turned off
+func (app *application) startAuthCacheListener(ctx context.Context) {
+	if app.authCache == nil {
+		return
+	}
+
+	listener := pq.NewListener(app.config.db.dsn, 10*time.Second, time.Minute, func(_ pq.ListenerEventType, err error) {
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"component": "auth_cache_listener",
+			})
+		}
+	})
+
+	err := listener.Listen(data.AuthCacheChannel)
+	if err != nil {
+		// the cache still works, entries just live out their TTL
+		// after a change made on another instance
+		app.logger.PrintError(err, map[string]string{
+			"component": "auth_cache_listener",
+		})
+	}
+
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		defer listener.Close()
+
+		// recover any panic so the listener can't take the server down
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.PrintError(fmt.Errorf("%s", err), map[string]string{
+					"component": "auth_cache_listener",
+				})
+			}
+		}()
+
+		ticker := time.NewTicker(authCacheListenerPing)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case n := <-listener.Notify:
+				// nil after the connection was re-established, anything
+				// sent in between is lost so start over
+				if n == nil {
+					app.authCache.Flush()
+					continue
+				}
+				app.authCache.Forget(n.Extra)
+			case <-ticker.C:
+				go listener.Ping()
+			}
+		}
+	}()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/meistens/api_practice/internal/data"
+	"github.com/meistens/api_practice/internal/validator"
+)
+
+// max. number of operations accepted in a single batch
+const batchMaxOperations = 100
+
+// supported batch operations, all of them need one of movieWritePerms and
+// update/delete are further limited to the user's own movies for
+// movies:write:own holders
+var batchOperations = []string{"create", "update", "delete"}
+
+// a single operation in a batch request
+// movie fields are pointers so update can do partial changes, same as
+// updateMovieHandler, version is the optional expected version (what the
+// X-Expected-Version header does for a single update)
+type batchOperation struct {
+	Op      string `json:"op"`
+	ID      int64  `json:"id,omitempty"`
+	Version *int32 `json:"version,omitempty"`
+	Movie   *struct {
+		Title   *string       `json:"title"`
+		Year    *int32        `json:"year"`
+		Runtime *data.Runtime `json:"runtime"`
+		Genres  []string      `json:"genres"`
+	} `json:"movie,omitempty"`
+}
+
+// per-operation outcome returned to the client
+type batchResult struct {
+	Op     string      `json:"op"`
+	Status int         `json:"status"`
+	Movie  *data.Movie `json:"movie,omitempty"`
+	Error  any         `json:"error,omitempty"`
+}
+
+// batchOpError carries the status and message for a failed operation
+type batchOpError struct {
+	status  int
+	message any
+}
+
+func (e *batchOpError) Error() string {
+	return fmt.Sprintf("%d: %v", e.status, e.message)
+}
+
+// POST /v1/batch
+// runs an ordered list of movie operations inside one transaction, if any
+// of them fails the whole batch is rolled back
+func (app *application) batchHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Operations []batchOperation `json:"operations"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.Operations) > 0, "operations", "must contain at least 1 operation")
+	v.Check(len(input.Operations) <= batchMaxOperations, "operations", fmt.Sprintf("must not contain more than %d operations", batchMaxOperations))
+	for i, op := range input.Operations {
+		key := fmt.Sprintf("operations[%d]", i)
+		v.Check(validator.In(op.Op, batchOperations...), key, "op must be one of create, update or delete")
+		v.Check(op.Op == "create" || op.ID > 0, key, "id must be provided")
+		v.Check(op.Op == "delete" || op.Movie != nil, key, "movie must be provided")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// permissions are fetched once and checked per operation
+	user := app.contextGetUser(r)
+
+	permissions, err := app.userPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := app.models.BeginTx(ctx)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	movies := app.models.Movies.WithTx(tx)
+
+	results := make([]batchResult, len(input.Operations))
+
+	for i, op := range input.Operations {
+		result, err := app.runBatchOperation(movies, user, permissions, op)
+		if err != nil {
+			var opErr *batchOpError
+			if !errors.As(err, &opErr) {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			// mark everything else as rolled back or skipped, and send the
+			// failing operation's status as the response status
+			for j := range results {
+				results[j] = batchResult{Op: input.Operations[j].Op, Status: http.StatusFailedDependency}
+				switch {
+				case j < i:
+					results[j].Error = "rolled back"
+				case j > i:
+					results[j].Error = "not executed"
+				}
+			}
+			results[i] = batchResult{Op: op.Op, Status: opErr.status, Error: opErr.message}
+
+			env := envelope{
+				"error":   fmt.Sprintf("operation %d failed, batch rolled back", i),
+				"results": results,
+			}
+			err = app.writeJSON(w, opErr.status, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		results[i] = *result
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"results": results}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// run a single batch operation with the same semantics as the matching movie
+// handler, client-side failures come back as a *batchOpError
+func (app *application) runBatchOperation(movies data.MovieModel, user *data.User, permissions data.Permissions, op batchOperation) (*batchResult, error) {
+	notPermitted := &batchOpError{http.StatusForbidden, "your user account doesn't have the necessary permissions for this operation"}
+
+	if !movieWrite.SatisfiedBy(permissions) {
+		return nil, notPermitted
+	}
+
+	switch op.Op {
+	case "create":
+		movie := &data.Movie{CreatedBy: user.ID}
+		if op.Movie.Title != nil {
+			movie.Title = *op.Movie.Title
+		}
+		if op.Movie.Year != nil {
+			movie.Year = *op.Movie.Year
+		}
+		if op.Movie.Runtime != nil {
+			movie.Runtime = *op.Movie.Runtime
+		}
+		movie.Genres = op.Movie.Genres
+
+		v := validator.New()
+		if data.ValidateMovie(v, movie); !v.Valid() {
+			return nil, &batchOpError{http.StatusUnprocessableEntity, v.Errors}
+		}
+
+		err := movies.Insert(movie)
+		if err != nil {
+			return nil, err
+		}
+		exposeMovieOwners(permissions, movie)
+		return &batchResult{Op: op.Op, Status: http.StatusCreated, Movie: movie}, nil
+
+	case "update":
+		movie, err := movies.Get(op.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				return nil, &batchOpError{http.StatusNotFound, "404 not found..."}
+			default:
+				return nil, err
+			}
+		}
+
+		if !canWriteMovie(user, permissions, movie) {
+			return nil, notPermitted
+		}
+
+		if op.Version != nil && *op.Version != movie.Version {
+			return nil, &batchOpError{http.StatusConflict, "unable to update record due to an edit conflict"}
+		}
+
+		if op.Movie.Title != nil {
+			movie.Title = *op.Movie.Title
+		}
+		if op.Movie.Year != nil {
+			movie.Year = *op.Movie.Year
+		}
+		if op.Movie.Runtime != nil {
+			movie.Runtime = *op.Movie.Runtime
+		}
+		if op.Movie.Genres != nil {
+			movie.Genres = op.Movie.Genres
+		}
+		movie.UpdatedBy = user.ID
+
+		v := validator.New()
+		if data.ValidateMovie(v, movie); !v.Valid() {
+			return nil, &batchOpError{http.StatusUnprocessableEntity, v.Errors}
+		}
+
+		err = movies.Update(movie)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				return nil, &batchOpError{http.StatusConflict, "unable to update record due to an edit conflict"}
+			default:
+				return nil, err
+			}
+		}
+		exposeMovieOwners(permissions, movie)
+		return &batchResult{Op: op.Op, Status: http.StatusOK, Movie: movie}, nil
+
+	case "delete":
+		// the ownership check is part of the delete, as in deleteMovieHandler
+		var err error
+		switch {
+		case permissions.Include("movies:write"):
+			err = movies.Delete(op.ID)
+		case permissions.Include("movies:write:own"):
+			err = movies.DeleteOwned(op.ID, user.ID)
+		default:
+			err = data.ErrNotOwner
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				return nil, &batchOpError{http.StatusNotFound, "404 not found..."}
+			case errors.Is(err, data.ErrNotOwner):
+				return nil, notPermitted
+			default:
+				return nil, err
+			}
+		}
+		return &batchResult{Op: op.Op, Status: http.StatusOK}, nil
+	}
+
+	// unreachable, ops are validated before the batch starts
+	return nil, fmt.Errorf("unsupported batch operation %q", op.Op)
+}
@@ -13,6 +13,15 @@ type contextKey string
 // convert string user to a contextKey type and assign to usercontextkey
 const userContextKey = contextKey("user")
 
+// plaintext of the bearer token the request was authenticated with
+const tokenContextKey = contextKey("token")
+
+// permissions carried by a signed token, only set for stateless requests
+const permissionsContextKey = contextKey("permissions")
+
+// client and scopes of an OAuth access token
+const oauthGrantContextKey = contextKey("oauth_grant")
+
 // return a new copy of request with contextsetuser()
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -27,3 +36,51 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// return a new copy of request with the bearer token added to the context
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// retrieve the bearer token from the request context, empty for
+// anonymous requests
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// return a new copy of request with the permissions from a signed token
+// added to the context, which also marks the request as stateless
+func (app *application) contextSetPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+// retrieve the permissions from a signed token, ok is false if the request
+// wasn't authenticated with one
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, bool) {
+	permissions, ok := r.Context().Value(permissionsContextKey).(data.Permissions)
+	return permissions, ok
+}
+
+// check if the request was authenticated with a signed token, in which case
+// the user in the context is only partially filled in
+func (app *application) contextIsStateless(r *http.Request) bool {
+	_, ok := app.contextGetPermissions(r)
+	return ok
+}
+
+// return a new copy of request with the grant behind an OAuth access token
+// added to the context
+func (app *application) contextSetOAuthGrant(r *http.Request, grant *data.OAuthGrant) *http.Request {
+	ctx := context.WithValue(r.Context(), oauthGrantContextKey, grant)
+	return r.WithContext(ctx)
+}
+
+// retrieve the OAuth grant, ok is false if the request wasn't made with an
+// OAuth access token
+func (app *application) contextGetOAuthGrant(r *http.Request) (*data.OAuthGrant, bool) {
+	grant, ok := r.Context().Value(oauthGrantContextKey).(*data.OAuthGrant)
+	return grant, ok
+}
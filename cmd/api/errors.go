@@ -2,7 +2,12 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/meistens/api_practice/internal/data"
 )
 
 func (app *application) logError(r *http.Request, err error) {
@@ -60,6 +65,12 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
+// use for 412, If-Match header doesn't match the current version
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the resource has been changed since you last fetched it, fetch it again and retry"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+
 // use for 429|rate limit exceeds
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
@@ -80,6 +91,12 @@ func (app *application) invalidAuthTokenResponse(w http.ResponseWriter, r *http.
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+// 401, refresh token unknown, expired or already used
+func (app *application) invalidRefreshTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or expired refresh token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
 // 401, for auth
 func (app *application) authRequiredReponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
@@ -92,7 +109,79 @@ func (app *application) inactiveAccResponse(w http.ResponseWriter, r *http.Reque
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+// 403, account suspended by an admin
+func (app *application) accountSuspendedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been suspended"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+// 403, an admin handing out or taking away a permission they don't hold
+func (app *application) cannotDelegateResponse(w http.ResponseWriter, r *http.Request, code string) {
+	message := fmt.Sprintf("you can't grant or revoke %s without holding it yourself", code)
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// 403, permission held but withheld until 2FA is enabled
+func (app *application) mfaRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you must enable two-factor authentication to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// 401, 2FA code or recovery code didn't match
+func (app *application) invalidMFACodeResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid two-factor authentication code"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// errors from the OAuth token endpoint, in the format RFC 6749 section 5.2
+// expects rather than the usual envelope
+func (app *application) oauthErrorResponse(w http.ResponseWriter, r *http.Request, status int, code, description string) {
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+
+	env := envelope{"error": code, "error_description": description}
+
+	err := app.writeJSON(w, status, env, headers)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
+
+// 422, idempotency key reused with a different request
+func (app *application) idempotencyKeyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this idempotency key has already been used with a different request"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
+
+// 409, original request for the idempotency key is still being processed
+func (app *application) idempotencyKeyInFlightResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+
+	message := "a request with this idempotency key is already being processed, do try again in a few seconds"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// 429, too many failed logins for the account or from the client's IP,
+// Retry-After says when the next attempt will be looked at
+func (app *application) tooManyLoginAttemptsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration, message string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// 429 for an account backing off or locked after failed logins, the owner
+// is emailed an unlock token when it's locked for good
+func (app *application) accountLockedResponse(w http.ResponseWriter, r *http.Request, lockout *data.Lockout, now time.Time) {
+	message := "too many failed login attempts for this account, please try again later"
+	if lockout.Failures >= app.config.login.lockoutThreshold {
+		message = "this account has been locked after too many failed login attempts, check your email to unlock it"
+	}
+	app.tooManyLoginAttemptsResponse(w, r, lockout.LockedUntil.Sub(now), message)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/meistens/api_practice/internal/data"
+	"github.com/meistens/api_practice/internal/validator"
+	"github.com/tomasen/realip"
+)
+
+// what became of a request made for an email address, kept in the
+// security event's metadata rather than told to the client
+const (
+	outcomeSent             = "sent"
+	outcomeUnknownEmail     = "unknown_email"
+	outcomeNotActivated     = "not_activated"
+	outcomeAlreadyActivated = "already_activated"
+)
+
+// who a request came from, for recording security events after the
+// request has finished
+type requestInfo struct {
+	IP        string
+	UserAgent string
+	ActorID   int64
+}
+
+// copy what a security event needs out of the request, the actor is
+// whoever the request is authenticated as, if anyone
+func (app *application) requestInfo(r *http.Request) requestInfo {
+	info := requestInfo{
+		IP:        realip.FromRequest(r),
+		UserAgent: r.UserAgent(),
+	}
+
+	if actor := app.contextGetUser(r); !actor.IsAnon() {
+		info.ActorID = actor.ID
+	}
+	return info
+}
+
+// record a security event about userID's account during a request
+func (app *application) recordSecurityEvent(r *http.Request, eventType string, userID int64, metadata map[string]string) {
+	app.recordEvent(app.requestInfo(r), eventType, userID, metadata)
+}
+
+// record a security event about userID's account, for background work
+// which can't touch the request any more
+// failures are only logged, whatever happened has happened by now
+func (app *application) recordEvent(info requestInfo, eventType string, userID int64, metadata map[string]string) {
+	event := &data.SecurityEvent{
+		Type:      eventType,
+		UserID:    userID,
+		ActorID:   info.ActorID,
+		IP:        info.IP,
+		UserAgent: info.UserAgent,
+		Metadata:  metadata,
+	}
+
+	err := app.models.Events.Insert(event)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{
+			"component": "security_events",
+			"type":      eventType,
+			"user_id":   strconv.FormatInt(userID, 10),
+		})
+	}
+}
+
+// read the filters shared by both security event listings, the caller
+// decides whose events they can see
+func (app *application) readSecurityEventFilters(r *http.Request, v *validator.Validator) (data.SecurityEventFilter, data.Filters) {
+	qs := r.URL.Query()
+
+	filter := data.SecurityEventFilter{
+		Types: app.readCSV(qs, "type", nil),
+		IP:    app.readString(qs, "ip", ""),
+		Since: app.readTime(qs, "since", v),
+		Until: app.readTime(qs, "until", v),
+	}
+
+	var filters data.Filters
+
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	filters.Sort = app.readString(qs, "sort", "-created_at")
+	filters.SortSafelist = []string{"created_at", "-created_at"}
+
+	return filter, filters
+}
+
+// GET /v1/admin/security-events
+// every user's events, user_id and actor_id narrow it down to one user's
+// account or what one user did
+func (app *application) listSecurityEventsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	filter, filters := app.readSecurityEventFilters(r, v)
+
+	qs := r.URL.Query()
+	filter.UserID = int64(app.readInt(qs, "user_id", 0, v))
+	filter.ActorID = int64(app.readInt(qs, "actor_id", 0, v))
+
+	app.writeSecurityEvents(w, r, v, filter, filters)
+}
+
+// GET /v1/users/me/security-events
+// the events about the user's own account, whoever caused them
+func (app *application) listCurrentUserSecurityEventsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	filter, filters := app.readSecurityEventFilters(r, v)
+	filter.UserID = app.contextGetUser(r).ID
+	// an admin's IP and user agent aren't the user's to see
+	filter.HideActors = true
+
+	app.writeSecurityEvents(w, r, v, filter, filters)
+}
+
+func (app *application) writeSecurityEvents(w http.ResponseWriter, r *http.Request, v *validator.Validator, filter data.SecurityEventFilter, filters data.Filters) {
+	data.ValidateFilters(v, filters)
+	data.ValidateSecurityEventFilter(v, filter)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	events, metadata, err := app.models.Events.GetAll(filter, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"security_events": events, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"maps"
 
@@ -187,6 +188,64 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// readBool reads an optional true/false value from the query string,
+// returning nil if there's no matching key
+// if it cannot be converted, record err msg in provided validator instance
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be true or false")
+		return nil
+	}
+	return &b
+}
+
+// readTime reads an optional RFC 3339 timestamp from the query string,
+// returning nil if there's no matching key
+// if it cannot be parsed, record err msg in provided validator instance
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) *time.Time {
+	s := qs.Get(key)
+
+	if s == "" {
+		return nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v.AddError(key, "must be an RFC 3339 timestamp")
+		return nil
+	}
+	return &t
+}
+
+// format a record version as a strong ETag value
+func versionETag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// check an If-Match request header against the current record version
+// a missing header or "*" always matches
+func (app *application) ifMatch(r *http.Request, version int) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == versionETag(version) {
+			return true
+		}
+	}
+	return false
+}
+
 // catching panics from background goroutines
 // background helper accepts an arbitary function as a param
 func (app *application) background(fn func()) {
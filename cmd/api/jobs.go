@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// how often the account purger looks for accounts due for deletion, and how
+// many it deletes per transaction
+const (
+	accountPurgeInterval  = time.Hour
+	accountPurgeBatchSize = 100
+)
+
+// how often the token reaper deletes expired tokens, idempotency keys and
+// denylist entries, and how many it deletes per statement so it never
+// holds locks on a table for long
+const (
+	tokenReapInterval  = 10 * time.Minute
+	tokenReapBatchSize = 1000
+)
+
+// postgres advisory lock held by the instance running the token reaper,
+// any number will do as long as nothing else uses it
+const tokenReaperLockID = 480048
+
+// start a background goroutine which deletes accounts whose scheduled
+// deletion time has passed, it stops when ctx is cancelled
+func (app *application) startAccountPurger(ctx context.Context) {
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+
+		// recover any panic so the purger can't take the server down
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.PrintError(fmt.Errorf("%s", err), map[string]string{
+					"component": "account_purger",
+				})
+			}
+		}()
+
+		ticker := time.NewTicker(accountPurgeInterval)
+		defer ticker.Stop()
+
+		for {
+			app.purgeAccounts(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// delete due accounts in batches until there are none left
+func (app *application) purgeAccounts(ctx context.Context) {
+	for ctx.Err() == nil {
+		ids, err := app.models.Users.PurgeScheduled(accountPurgeBatchSize)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"component": "account_purger",
+			})
+			return
+		}
+		if len(ids) == 0 {
+			return
+		}
+
+		app.logger.PrintInfo("purged deleted accounts", map[string]string{
+			"component": "account_purger",
+			"count":     strconv.Itoa(len(ids)),
+		})
+
+		if len(ids) < accountPurgeBatchSize {
+			return
+		}
+	}
+}
+
+// start a background goroutine which deletes expired tokens, idempotency
+// keys and denylist entries, it stops when ctx is cancelled
+// every instance runs one, but only the one holding the advisory lock
+// deletes anything each time round
+func (app *application) startTokenReaper(ctx context.Context) {
+	// runs, runs skipped because another instance held the lock, and rows
+	// deleted from each table since startup
+	stats := expvar.NewMap("token_reaper")
+
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+
+		// recover any panic so the reaper can't take the server down
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.PrintError(fmt.Errorf("%s", err), map[string]string{
+					"component": "token_reaper",
+				})
+			}
+		}()
+
+		ticker := time.NewTicker(tokenReapInterval)
+		defer ticker.Stop()
+
+		for {
+			app.reapTokens(ctx, stats)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// delete expired tokens, idempotency keys and denylist entries in batches
+// until there are none left, if no other instance is doing it already
+func (app *application) reapTokens(ctx context.Context, stats *expvar.Map) {
+	// tokens keep the "deleted" stat they've always had
+	tables := []struct {
+		name        string
+		stat        string
+		deleteBatch func(limit int) (int64, error)
+	}{
+		{"tokens", "deleted", app.models.Tokens.DeleteExpired},
+		{"idempotency_keys", "deleted_idempotency_keys", app.models.Idempotency.DeleteExpired},
+		{"token_denylist", "deleted_denylist", app.models.Denylist.DeleteExpired},
+	}
+	deletedPer := make([]int64, len(tables))
+
+	acquired, err := app.models.WithAdvisoryLock(ctx, tokenReaperLockID, func() error {
+		for i, table := range tables {
+			for ctx.Err() == nil {
+				n, err := table.deleteBatch(tokenReapBatchSize)
+				if err != nil {
+					return fmt.Errorf("%s: %w", table.name, err)
+				}
+				deletedPer[i] += n
+				stats.Add(table.stat, n)
+
+				if n < tokenReapBatchSize {
+					break
+				}
+			}
+		}
+		return nil
+	})
+
+	counts := map[string]string{"component": "token_reaper"}
+	var deleted int64
+	for i, table := range tables {
+		counts[table.name] = strconv.FormatInt(deletedPer[i], 10)
+		deleted += deletedPer[i]
+	}
+
+	if err != nil {
+		app.logger.PrintError(err, counts)
+		return
+	}
+	if !acquired {
+		stats.Add("skipped", 1)
+		return
+	}
+	stats.Add("runs", 1)
+
+	if deleted > 0 {
+		app.logger.PrintInfo("deleted expired rows", counts)
+	}
+}
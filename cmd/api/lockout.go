@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/meistens/api_practice/internal/data"
+	"github.com/meistens/api_practice/internal/validator"
+	"github.com/tomasen/realip"
+)
+
+// brute-force protection for password logins
+// failures on an account are free up to loginFreeFailures, after that
+// each one makes the account wait twice as long before the next attempt,
+// and at the lockout threshold it's locked and the owner is emailed a
+// token to unlock it
+// failures from an IP are counted over a window and back off the same way
+// once its free attempts are used up
+const (
+	loginFreeFailures = 3
+	loginBaseDelay    = time.Second
+	loginMaxDelay     = 15 * time.Minute
+	unlockTokenTTL    = 24 * time.Hour
+)
+
+// how many attempts the admin login history returns
+const loginHistoryLimit = 100
+
+// 2^(n-1) * loginBaseDelay, capped at loginMaxDelay
+func loginBackoff(n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	// past this the shift would overflow, and we're well past the cap anyway
+	if n > 30 {
+		return loginMaxDelay
+	}
+	return min(loginBaseDelay<<(n-1), loginMaxDelay)
+}
+
+// when an account with this many failures can next be tried, nil if it can
+// be tried straight away
+func (app *application) accountLockedUntil(failures int, now time.Time) *time.Time {
+	var until time.Time
+
+	switch {
+	case failures >= app.config.login.lockoutThreshold:
+		until = now.Add(app.config.login.lockoutDuration)
+	case failures > loginFreeFailures:
+		until = now.Add(loginBackoff(failures - loginFreeFailures))
+	default:
+		return nil
+	}
+	return &until
+}
+
+// how long the IP has to wait before its next login attempt, 0 if it
+// doesn't
+func (app *application) ipLoginDelay(ip string, now time.Time) (time.Duration, error) {
+	failures, latest, err := app.models.LoginAttempts.IPFailures(ip, now.Add(-app.config.login.ipWindow))
+	if err != nil {
+		return 0, err
+	}
+	if failures < app.config.login.ipFreeAttempts {
+		return 0, nil
+	}
+
+	wait := latest.Add(loginBackoff(failures - app.config.login.ipFreeAttempts + 1)).Sub(now)
+	return max(wait, 0), nil
+}
+
+// record a login attempt, failing to do so is logged rather than failing
+// the login
+func (app *application) recordLoginAttempt(userID int64, email, ip, outcome string) {
+	attempt := &data.LoginAttempt{UserID: userID, Email: email, IP: ip, Outcome: outcome}
+
+	err := app.models.LoginAttempts.Insert(attempt)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{
+			"component": "login_attempts",
+		})
+	}
+}
+
+// count a wrong password against the account, locking it and emailing the
+// owner an unlock token when it reaches the threshold
+func (app *application) recordLoginFailure(r *http.Request, user *data.User) error {
+	now := time.Now()
+
+	lockout, err := app.models.LoginAttempts.RecordFailure(user.ID, func(failures int) *time.Time {
+		return app.accountLockedUntil(failures, now)
+	})
+	if err != nil {
+		return err
+	}
+
+	if lockout.Failures < app.config.login.lockoutThreshold {
+		return nil
+	}
+
+	app.logger.PrintInfo("account locked after failed logins", map[string]string{
+		"user_id":  strconv.FormatInt(user.ID, 10),
+		"failures": strconv.Itoa(lockout.Failures),
+	})
+	app.recordSecurityEvent(r, data.EventAccountLocked, user.ID, map[string]string{
+		"failures": strconv.Itoa(lockout.Failures),
+	})
+
+	token, err := app.models.Tokens.New(user.ID, unlockTokenTTL, data.ScopeUnlock)
+	if err != nil {
+		return err
+	}
+
+	app.background(func() {
+		data := map[string]any{
+			"unlockToken":     token.Plaintext,
+			"lockoutDuration": app.config.login.lockoutDuration.String(),
+		}
+
+		err := app.mailer.Send(user.Email, "account_unlock.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+	return nil
+}
+
+// check the password a logged in user sends to confirm a sensitive change,
+// which is subject to the same lockout as logging in, so a stolen bearer
+// token can't be used to guess it
+// a wrong password is reported under key as a validation error, or as
+// invalid credentials if key is empty, false means a response was sent
+func (app *application) confirmPassword(w http.ResponseWriter, r *http.Request, user *data.User, plaintext, key string) bool {
+	ip := realip.FromRequest(r)
+
+	lockout, err := app.models.LoginAttempts.GetLockout(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if now := time.Now(); lockout.Active(now) {
+		app.recordLoginAttempt(user.ID, user.Email, ip, data.LoginLocked)
+		app.accountLockedResponse(w, r, lockout, now)
+		return false
+	}
+
+	match, _, err := user.Password.Matches(plaintext)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !match {
+		app.recordLoginAttempt(user.ID, user.Email, ip, data.LoginInvalidCredentials)
+		app.recordSecurityEvent(r, data.EventLoginFailed, user.ID, map[string]string{
+			"reason": "invalid_credentials",
+			"path":   r.URL.Path,
+		})
+
+		err = app.recordLoginFailure(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+
+		if key == "" {
+			app.invalidCredentialsResponse(w, r)
+			return false
+		}
+		v := validator.New()
+		v.AddError(key, "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	// as with a login, the right password starts the count afresh
+	if lockout.Failures > 0 {
+		err = app.models.LoginAttempts.ClearLockout(user.ID)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+	}
+	return true
+}
+
+// PUT /v1/users/unlocked
+// unlock an account with the token emailed when it was locked
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeUnlock, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired unlock token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the lock may have expired, or been cleared by a login, since the
+	// email went out, which is fine
+	err = app.models.LoginAttempts.ClearLockout(user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeUnlock, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.recordSecurityEvent(r, data.EventAccountUnlocked, user.ID, nil)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your account has been unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// DELETE /v1/admin/users/:id/lockout
+// clear a user's failed logins and any lockout
+func (app *application) adminUnlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.LoginAttempts.ClearLockout(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeUnlock, id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo("account unlocked by admin", map[string]string{
+		"user_id":  strconv.FormatInt(id, 10),
+		"admin_id": strconv.FormatInt(app.contextGetUser(r).ID, 10),
+	})
+	app.recordSecurityEvent(r, data.EventAccountUnlocked, id, nil)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "lockout successfully cleared"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// GET /v1/admin/users/:id/login-attempts
+// a user's most recent login attempts, successful and failed
+func (app *application) listLoginAttemptsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	attempts, err := app.models.LoginAttempts.GetAllForUser(id, loginHistoryLimit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"login_attempts": attempts}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/meistens/api_practice/internal/data"
+	"github.com/meistens/api_practice/internal/validator"
+)
+
+// how long a login link stays valid
+const magicLinkTTL = 15 * time.Minute
+
+// POST /v1/tokens/magic-link
+// email the user a one-time login token
+// the response is the same whether or not the address has an account, and
+// the lookup happens in the background so the timing doesn't tell either
+func (app *application) createMagicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.background(func() {
+		err := app.sendMagicLink(input.Email)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"component": "magic_link",
+			})
+		}
+	})
+
+	env := envelope{"message": "if an account exists for this email address, a login link will be sent to it"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// look up the account for an email address and send it a login token,
+// addresses without an account (or belonging to a service account) are
+// quietly ignored
+func (app *application) sendMagicLink(email string) error {
+	user, err := app.models.Users.GetByEmail(email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil
+		default:
+			return err
+		}
+	}
+	if user.ServiceAccount {
+		return nil
+	}
+
+	token, err := app.models.Tokens.New(user.ID, magicLinkTTL, data.ScopeMagicLink)
+	if err != nil {
+		return err
+	}
+
+	data := map[string]any{
+		"magicLinkToken": token.Plaintext,
+	}
+
+	return app.mailer.Send(user.Email, "token_magic_link.tmpl", data)
+}
+
+// POST /v1/tokens/magic-link/redeem
+// exchange a login token for an authentication token, the same way a
+// password login would (so users with 2FA still need their code)
+func (app *application) redeemMagicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// the token is deleted as it's looked up, so it can't be redeemed twice
+	user, err := app.models.Users.ConsumeToken(data.ScopeMagicLink, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired login token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// getting the token out of their inbox proves the address is theirs,
+	// which is all activation does
+	if !user.Activated {
+		user.Activated = true
+
+		err = app.models.Users.Update(user)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.logger.PrintInfo("user activated through magic link", map[string]string{
+			"user_id": strconv.FormatInt(user.ID, 10),
+		})
+	}
+
+	app.completeLogin(w, r, user)
+}
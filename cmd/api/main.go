@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
+	"math"
 	"os"
 	"runtime"
 	"strings"
@@ -15,7 +17,10 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/meistens/api_practice/internal/data"
 	"github.com/meistens/api_practice/internal/jsonlog"
+	"github.com/meistens/api_practice/internal/jwt"
 	"github.com/meistens/api_practice/internal/mailer"
+	"github.com/meistens/api_practice/internal/oidc"
+	"github.com/meistens/api_practice/internal/validator"
 )
 
 // buildtime variable to hold the executable binary build time
@@ -60,6 +65,74 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	// how long computed catalogue stats are served from memory
+	stats struct {
+		cacheTTL time.Duration
+	}
+	// how long responses for an Idempotency-Key are kept for replay
+	idempotency struct {
+		ttl time.Duration
+	}
+	// lifetimes of the access and refresh tokens issued at login
+	// mode is "opaque" (tokens looked up in postgres) or "signed"
+	// (stateless signed access tokens), signingKeys are "kid:alg:base64key"
+	// entries and the first one signs
+	// authentication token lookups and user permissions are cached in
+	// memory for cacheTTL, up to cacheSize entries of each, 0 turns it off
+	// revealAccounts tells clients which email addresses have no account,
+	// only allowed in development
+	auth struct {
+		accessTTL      time.Duration
+		refreshTTL     time.Duration
+		mode           string
+		signingKeys    []string
+		cacheTTL       time.Duration
+		cacheSize      int
+		revealAccounts bool
+	}
+	// how long a user has to change their mind after asking for
+	// their account to be deleted
+	accounts struct {
+		deletionGrace time.Duration
+	}
+	// permission codes which are withheld from users until they have
+	// enabled two-factor authentication
+	mfa struct {
+		requiredFor []string
+	}
+	// external OpenID Connect provider, login through it is off unless
+	// issuer is set
+	oidc struct {
+		issuer       string
+		clientID     string
+		clientSecret string
+		redirectURI  string
+	}
+	// brute-force protection for password logins, failures per account
+	// back off exponentially until the account is locked, failures per
+	// IP back off once the free attempts in the window are used up
+	login struct {
+		lockoutThreshold int
+		lockoutDuration  time.Duration
+		ipFreeAttempts   int
+		ipWindow         time.Duration
+	}
+	// role new users are given, none if empty
+	roles struct {
+		defaultRole string
+	}
+	// rules for new passwords, the breached password check is off unless
+	// breachedDir is set
+	password struct {
+		minLength   int
+		minEntropy  float64
+		breachedDir string
+		// argon2id parameters for new hashes, hashes made with other
+		// parameters are replaced on the next login
+		argon2Memory      uint
+		argon2Iterations  uint
+		argon2Parallelism uint
+	}
 }
 
 // define app struct to hold deps for the HTTP handlers,
@@ -70,6 +143,18 @@ type application struct {
 	models data.Models
 	mailer mailer.Mailer
 	wg     sync.WaitGroup
+	// cache for the /v1/stats/movies endpoint
+	statsCache *statsCache
+	// cache behind the models' token and permission lookups, nil when
+	// it's turned off
+	authCache *data.AuthCache
+	// keys for signed access tokens, nil when none are configured
+	signingKeys *jwt.KeySet
+	denylist    *tokenDenylist
+	// external login provider, nil when it isn't configured
+	oidc *oidc.Provider
+	// rules new passwords are checked against
+	passwords *validator.PasswordPolicy
 }
 
 func main() {
@@ -113,6 +198,54 @@ func main() {
 		return nil
 	})
 
+	// stats cache ttl, the dashboard polls every few seconds
+	flag.DurationVar(&cfg.stats.cacheTTL, "stats-cache-ttl", 30*time.Second, "Movie stats cache TTL")
+
+	flag.DurationVar(&cfg.idempotency.ttl, "idempotency-ttl", 24*time.Hour, "Idempotency-Key response retention")
+
+	flag.DurationVar(&cfg.auth.accessTTL, "auth-access-ttl", 15*time.Minute, "Access token lifetime")
+	flag.DurationVar(&cfg.auth.refreshTTL, "auth-refresh-ttl", 30*24*time.Hour, "Refresh token lifetime")
+
+	flag.DurationVar(&cfg.auth.cacheTTL, "auth-cache-ttl", 30*time.Second, "Token and permission cache TTL (0 disables)")
+	flag.IntVar(&cfg.auth.cacheSize, "auth-cache-size", 10000, "Token and permission cache maximum entries")
+
+	flag.BoolVar(&cfg.auth.revealAccounts, "auth-reveal-accounts", false, "Say when an email address has no account on login, password reset and activation (development only)")
+
+	flag.StringVar(&cfg.auth.mode, "auth-mode", "opaque", "Access token mode (opaque|signed)")
+	flag.Func("auth-signing-keys", "Access token signing keys as kid:alg:base64key, space separated, first one signs (alg EdDSA|HS256)", func(val string) error {
+		cfg.auth.signingKeys = strings.Fields(val)
+		return nil
+	})
+
+	flag.DurationVar(&cfg.accounts.deletionGrace, "account-deletion-grace", 30*24*time.Hour, "Grace period before a deleted account is purged")
+
+	// movies:write needs 2FA unless the flag says otherwise, an empty value
+	// turns the policy off
+	cfg.mfa.requiredFor = []string{"movies:write"}
+	flag.Func("mfa-required-for", "Permission codes which need two-factor authentication enabled (space separated, default \"movies:write\")", func(val string) error {
+		cfg.mfa.requiredFor = strings.Fields(val)
+		return nil
+	})
+
+	flag.IntVar(&cfg.login.lockoutThreshold, "login-lockout-threshold", 10, "Failed logins before an account is locked")
+	flag.DurationVar(&cfg.login.lockoutDuration, "login-lockout-duration", time.Hour, "How long a locked account stays locked")
+	flag.IntVar(&cfg.login.ipFreeAttempts, "login-ip-free-attempts", 20, "Failed logins from an IP before it is slowed down")
+	flag.DurationVar(&cfg.login.ipWindow, "login-ip-window", 15*time.Minute, "Window failed logins from an IP are counted over")
+
+	flag.StringVar(&cfg.roles.defaultRole, "default-role", "viewer", "Role given to new users (empty for none)")
+
+	flag.IntVar(&cfg.password.minLength, "password-min-length", 8, "Minimum new password length in characters")
+	flag.Float64Var(&cfg.password.minEntropy, "password-min-entropy", 40, "Minimum new password strength in bits (0 to disable)")
+	flag.StringVar(&cfg.password.breachedDir, "password-breached-dir", "", "Directory of breached password SHA-1 range files (HIBP format)")
+	flag.UintVar(&cfg.password.argon2Memory, "password-argon2-memory", uint(data.DefaultArgon2Params.Memory), "Argon2id memory in KiB")
+	flag.UintVar(&cfg.password.argon2Iterations, "password-argon2-iterations", uint(data.DefaultArgon2Params.Iterations), "Argon2id iterations")
+	flag.UintVar(&cfg.password.argon2Parallelism, "password-argon2-parallelism", uint(data.DefaultArgon2Params.Parallelism), "Argon2id parallelism")
+
+	flag.StringVar(&cfg.oidc.issuer, "oidc-issuer", "", "OpenID Connect issuer URL (enables external login)")
+	flag.StringVar(&cfg.oidc.clientID, "oidc-client-id", "", "OpenID Connect client ID")
+	flag.StringVar(&cfg.oidc.clientSecret, "oidc-client-secret", "", "OpenID Connect client secret")
+	flag.StringVar(&cfg.oidc.redirectURI, "oidc-redirect-uri", "http://localhost:4000/v1/oidc/callback", "OpenID Connect redirect URI")
+
 	// create a new version bool flag with the default value of false
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
@@ -143,6 +276,83 @@ func main() {
 	// prefixed with current date and time
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
+	// telling clients which addresses have accounts is a development aid,
+	// it mustn't end up switched on anywhere else
+	if cfg.auth.revealAccounts && cfg.env != "development" {
+		logger.PrintFatal(errors.New("-auth-reveal-accounts is only allowed with -env development"), nil)
+	}
+
+	// parse the signing keys, they're needed to issue signed tokens and
+	// kept around after switching back to opaque mode so tokens already
+	// issued still verify
+	var signingKeys *jwt.KeySet
+	if cfg.auth.mode != "opaque" && cfg.auth.mode != "signed" {
+		logger.PrintFatal(fmt.Errorf("invalid auth mode %q", cfg.auth.mode), nil)
+	}
+	if len(cfg.auth.signingKeys) > 0 {
+		keys := make([]*jwt.Key, 0, len(cfg.auth.signingKeys))
+		for _, spec := range cfg.auth.signingKeys {
+			key, err := jwt.ParseKey(spec)
+			if err != nil {
+				logger.PrintFatal(err, nil)
+			}
+			keys = append(keys, key)
+		}
+
+		var err error
+		signingKeys, err = jwt.NewKeySet(keys...)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	} else if cfg.auth.mode == "signed" {
+		logger.PrintFatal(fmt.Errorf("auth mode signed requires at least one -auth-signing-keys entry"), nil)
+	}
+
+	// discover the login provider's endpoints and keys up front, so a
+	// misconfiguration shows up at startup rather than on the first login
+	var provider *oidc.Provider
+	if cfg.oidc.issuer != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+		var err error
+		provider, err = oidc.Discover(ctx, oidc.Config{
+			Issuer:       cfg.oidc.issuer,
+			ClientID:     cfg.oidc.clientID,
+			ClientSecret: cfg.oidc.clientSecret,
+			RedirectURI:  cfg.oidc.redirectURI,
+		})
+		cancel()
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		logger.PrintInfo("oidc provider discovered", map[string]string{"issuer": cfg.oidc.issuer})
+	}
+
+	// argon2 panics on parameters it can't work with, so catch them here
+	if cfg.password.argon2Iterations < 1 || cfg.password.argon2Parallelism < 1 || cfg.password.argon2Parallelism > 255 ||
+		cfg.password.argon2Memory < 8*cfg.password.argon2Parallelism || cfg.password.argon2Memory > math.MaxUint32 {
+		logger.PrintFatal(errors.New("invalid argon2id parameters"), nil)
+	}
+	data.SetPasswordParams(data.Argon2Params{
+		Memory:      uint32(cfg.password.argon2Memory),
+		Iterations:  uint32(cfg.password.argon2Iterations),
+		Parallelism: uint8(cfg.password.argon2Parallelism),
+		SaltLength:  data.DefaultArgon2Params.SaltLength,
+		KeyLength:   data.DefaultArgon2Params.KeyLength,
+	})
+
+	passwords := &validator.PasswordPolicy{
+		MinLength:  cfg.password.minLength,
+		MinEntropy: cfg.password.minEntropy,
+	}
+	if cfg.password.breachedDir != "" {
+		var err error
+		passwords.Breached, err = validator.OpenBreachedPasswords(cfg.password.breachedDir)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
 	// call opendb() helper function to create conn. pool, passing the
 	// config struct
 	// if it returns an error, log it and exit
@@ -175,13 +385,35 @@ func main() {
 		return time.Now().Unix()
 	}))
 
+	// nil when turned off, which the models handle
+	authCache := data.NewAuthCache(db, cfg.auth.cacheTTL, cfg.auth.cacheSize)
+
+	// publish token and permission cache hits and misses
+	expvar.Publish("auth_cache", expvar.Func(func() any {
+		return authCache.Stats()
+	}))
+
 	// declare an instance of the app struct
 	// containing the config struct, logger, models
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:      cfg,
+		logger:      logger,
+		models:      data.NewModels(db, authCache),
+		mailer:      mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		statsCache:  newStatsCache(cfg.stats.cacheTTL),
+		authCache:   authCache,
+		signingKeys: signingKeys,
+		denylist:    newTokenDenylist(),
+		oidc:        provider,
+		passwords:   passwords,
+	}
+
+	// registrations would fail later on anyway, better to find out now
+	if cfg.roles.defaultRole != "" {
+		_, err = app.models.Roles.GetByName(cfg.roles.defaultRole)
+		if err != nil {
+			logger.PrintFatal(fmt.Errorf("default role %q: %w", cfg.roles.defaultRole, err), nil)
+		}
 	}
 
 	// optimize runtime settings
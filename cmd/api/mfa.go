@@ -0,0 +1,370 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/meistens/api_practice/internal/data"
+	"github.com/meistens/api_practice/internal/totp"
+	"github.com/meistens/api_practice/internal/validator"
+)
+
+// how long a user has to enter their 2FA code after the password
+const mfaPendingTTL = 5 * time.Minute
+
+// issuer shown next to the account in authenticator apps
+const totpIssuer = "Greenlight"
+
+// check if the request's user meets the 2FA policy, service accounts are
+// exempt as they can only use API keys, which an admin scoped already
+func (app *application) mfaSatisfied(r *http.Request) bool {
+	user := app.contextGetUser(r)
+	return user.TwoFactorEnabled || user.ServiceAccount
+}
+
+// the permissions the user can actually use, which leaves out the codes in
+// the -mfa-required-for policy until they've enabled 2FA
+func (app *application) mfaPermissions(r *http.Request, permissions data.Permissions) data.Permissions {
+	if len(app.config.mfa.requiredFor) == 0 || app.mfaSatisfied(r) {
+		return permissions
+	}
+	return permissions.Deny(app.config.mfa.requiredFor...)
+}
+
+// either a TOTP code or a recovery code has to be sent
+func validateMFAInput(v *validator.Validator, code, recoveryCode string) {
+	switch {
+	case recoveryCode != "":
+		data.ValidateRecoveryCode(v, recoveryCode)
+	default:
+		data.ValidateTOTPCode(v, code)
+	}
+}
+
+// check a TOTP code, or use up a recovery code if one was sent instead
+// a TOTP code is only accepted once
+func (app *application) checkMFACode(userID int64, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		err := app.models.TOTP.UseRecoveryCode(userID, recoveryCode)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				return false, nil
+			default:
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	secret, err := app.models.TOTP.GetSecret(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	err = app.models.TOTP.UseStep(userID, step)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTOTPReplayed):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// POST /v1/tokens/mfa
+// second login step, exchanges the mfa-pending token from
+// createAuthTokenHandler and a TOTP or recovery code for a token pair
+// the pending token is used up by the first attempt, right or wrong, so
+// each guess at a code costs a password login
+func (app *application) createMFATokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, input.MFAToken)
+	validateMFAInput(v, input.Code, input.RecoveryCode)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeMFAPending, input.MFAToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("mfa_token", "invalid or expired mfa token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeMFAPending, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	ok, err := app.checkMFACode(user.ID, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.recordSecurityEvent(r, data.EventLoginFailed, user.ID, map[string]string{"reason": "invalid_mfa_code"})
+		app.invalidMFACodeResponse(w, r)
+		return
+	}
+
+	app.startSession(w, r, user)
+}
+
+// POST /v1/users/me/2fa/totp
+// start enrolment, the secret isn't used for logins until a code from it
+// has been confirmed
+func (app *application) enrolTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user.TwoFactorEnabled {
+		app.badRequestResponse(w, r, errors.New("two-factor authentication is already enabled"))
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.SetPendingSecret(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTOTPEnabled):
+			app.badRequestResponse(w, r, errors.New("two-factor authentication is already enabled"))
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"totp": map[string]string{
+		"secret": totp.EncodeSecret(secret),
+		"uri":    totp.URI(totpIssuer, user.Email, secret),
+	}}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// PUT /v1/users/me/2fa/totp
+// confirm enrolment with a code from the authenticator app, which turns
+// 2FA on and returns the recovery codes (the only time they're shown)
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user.TwoFactorEnabled {
+		app.badRequestResponse(w, r, errors.New("two-factor authentication is already enabled"))
+		return
+	}
+
+	ok, err := app.checkMFACode(user.ID, input.Code, "")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		v.AddError("code", "invalid code, or no enrolment in progress")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	codes, err := app.models.TOTP.Enable(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.recordSecurityEvent(r, data.EventMFAEnabled, user.ID, nil)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// DELETE /v1/users/me/2fa/totp
+// turning 2FA off needs the password and a code, so a stolen token alone
+// can't do it
+func (app *application) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidatePasswordPlaintext(v, input.Password)
+	validateMFAInput(v, input.Code, input.RecoveryCode)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !user.TwoFactorEnabled {
+		app.badRequestResponse(w, r, errors.New("two-factor authentication is not enabled"))
+		return
+	}
+
+	if !app.confirmPassword(w, r, user, input.Password, "") {
+		return
+	}
+
+	ok, err := app.checkMFACode(user.ID, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.invalidMFACodeResponse(w, r)
+		return
+	}
+
+	err = app.models.TOTP.Disable(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// their signed tokens say 2FA is on, which would keep the permissions
+	// withheld without it
+	err = app.revokeSignedTokensForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.recordSecurityEvent(r, data.EventMFADisabled, user.ID, nil)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication has been disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// POST /v1/users/me/2fa/recovery-codes
+// replace the recovery codes, any unused old ones stop working
+func (app *application) newRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !user.TwoFactorEnabled {
+		app.badRequestResponse(w, r, errors.New("two-factor authentication is not enabled"))
+		return
+	}
+
+	ok, err := app.checkMFACode(user.ID, input.Code, "")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.invalidMFACodeResponse(w, r)
+		return
+	}
+
+	codes, err := app.models.TOTP.NewRecoveryCodes(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"expvar"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -12,6 +15,7 @@ import (
 
 	"github.com/felixge/httpsnoop"
 	"github.com/meistens/api_practice/internal/data"
+	"github.com/meistens/api_practice/internal/jwt"
 	"github.com/meistens/api_practice/internal/validator"
 	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
@@ -116,6 +120,13 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// add "Vary: Auth." header response
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
+
+		// service accounts can send their API key in its own header
+		if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+			app.authenticateAPIKey(w, r, next, apiKey)
+			return
+		}
 
 		// retrieve the value of the Auth. header from the request
 		// This will return the empty string "" if no header is found
@@ -132,6 +143,13 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// otherwise, we expect the value of the Auth. heade to be in the format
 		// "Bearer <>"
 		headerParts := strings.Split(authorizationHeader, " ")
+		// basic credentials are for OAuth clients at the token endpoint,
+		// which reads them itself
+		if len(headerParts) == 2 && headerParts[0] == "Basic" {
+			r = app.contextSetUser(r, data.AnonUser)
+			next.ServeHTTP(w, r)
+			return
+		}
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidCredentialsResponse(w, r)
 			return
@@ -140,6 +158,28 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// extract the actual token from header
 		token := headerParts[1]
 
+		// or as a bearer token, recognised by the gl_ prefix
+		if data.IsAPIKey(token) {
+			app.authenticateAPIKey(w, r, next, token)
+			return
+		}
+
+		// signed tokens are verified with the signing keys alone, opaque
+		// ones keep working alongside them during a migration
+		if app.signingKeys != nil && jwt.LooksSigned(token) {
+			user, permissions, err := app.authenticateSigned(token)
+			if err != nil {
+				app.invalidAuthTokenResponse(w, r)
+				return
+			}
+			r = app.contextSetUser(r, user)
+			r = app.contextSetToken(r, token)
+			r = app.contextSetPermissions(r, permissions)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// validate to see if it is the right format
 		v := validator.New()
 
@@ -156,21 +196,99 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
+			// could be an access token issued to an OAuth client
 			case errors.Is(err, data.ErrRecordNotFound):
-				app.invalidAuthTokenResponse(w, r)
+				app.authenticateOAuth(w, r, next, token)
 			default:
 				app.serverErrorResponse(w, r, err)
 			}
 			return
 		}
+		// suspension revokes the user's tokens, this catches any issued
+		// in between
+		if user.IsSuspended() {
+			app.accountSuspendedResponse(w, r)
+			return
+		}
 		// call contextsetuser() helper to add user info to the request ctx
+		// keep the token too, so the session it belongs to can be found
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
 
 		// call next handler in the chain
 		next.ServeHTTP(w, r)
 	})
 }
 
+// authenticate a request made with an API key, the service account behind
+// it gets only the permissions listed on the key
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, apiKey string) {
+	v := validator.New()
+
+	if data.ValidateAPIKeyPlaintext(v, apiKey); !v.Valid() {
+		app.invalidAuthTokenResponse(w, r)
+		return
+	}
+
+	user, permissions, err := app.models.APIKeys.GetForKey(apiKey)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// API keys aren't revoked by a suspension, they just stop working
+	if user.IsSuspended() {
+		app.accountSuspendedResponse(w, r)
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetToken(r, apiKey)
+	r = app.contextSetPermissions(r, permissions)
+
+	next.ServeHTTP(w, r)
+}
+
+// authenticate a request made with an OAuth access token, which only gets
+// the scopes the user consented to, and only while the user still holds them
+func (app *application) authenticateOAuth(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	user, grant, err := app.models.OAuth.GetForAccessToken(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.IsSuspended() {
+		app.accountSuspendedResponse(w, r)
+		return
+	}
+
+	held, err := app.models.Permissions.GetAllUserPerms(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions := held.Restrict(grant.Scopes)
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetToken(r, token)
+	r = app.contextSetPermissions(r, permissions)
+	r = app.contextSetOAuthGrant(r, grant)
+
+	next.ServeHTTP(w, r)
+}
+
 func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
 	// rather than return, assign it to a variable
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -203,24 +321,46 @@ func (app *application) requireAuthUser(next http.HandlerFunc) http.HandlerFunc
 	})
 }
 
-func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+// like requireAuthUser(), but also turns away OAuth access tokens, for the
+// endpoints which manage the account itself rather than using its data
+func (app *application) requireUserSession(next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		// retrieve user from the request context
-		user := app.contextGetUser(r)
+		if _, ok := app.contextGetOAuthGrant(r); ok {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return app.requireAuthUser(fn)
+}
 
-		// get the slice of permissions for the user
-		permissions, err := app.models.Permissions.GetAllUserPerms(user.ID)
+func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	return app.requirePermissions(data.Code(code), next)
+}
+
+// same as requirePermission(), but for a composite requirement made with
+// data.AnyOf() and data.AllOf()
+func (app *application) requirePermissions(req data.Requirement, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		// get the slice of permissions for the user from the request
+		// context (signed tokens) or the db
+		permissions, err := app.grantedPermissions(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
 
-		// check if the slice includes the required requirePermission
+		// check if the slice meets the requirement
 		// if not, return a 403
-		if !permissions.Include(code) {
+		if !req.SatisfiedBy(permissions) {
 			app.notPermittedResponse(w, r)
 			return
 		}
+		// held, but withheld until 2FA is enabled
+		if !req.SatisfiedBy(app.mfaPermissions(r, permissions)) {
+			app.mfaRequiredResponse(w, r)
+			return
+		}
 		next.ServeHTTP(w, r)
 	}
 	// wrap around the requireactivateduser() before returning
@@ -245,7 +385,7 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 						// Set the necessary preflight response headers, as discussed
 						// previously.
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Idempotency-Key, If-Match, X-API-Key")
 						// Write the headers along with a 200 OK status and return from
 						// the middleware with no further action.
 						w.WriteHeader(http.StatusOK)
@@ -289,3 +429,149 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		totalResSentByStat.Add(strconv.Itoa(metrics.Code), 1)
 	})
 }
+
+// how long an idempotency key is held while the original request is in flight
+// long enough to outlive the server's write timeout
+const idempotencyLockTTL = time.Minute
+
+// responseRecorder passes writes through to the wrapped ResponseWriter while
+// keeping a copy of the status code and body, so the response can be stored
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// honour the Idempotency-Key header on POST endpoints
+// the first request with a key is processed and its response stored, retries
+// with the same key and body get the stored response replayed, and a retry
+// with a different body is rejected with a 422
+// keys are scoped to the authenticated user (anonymous requests share id 0)
+func (app *application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		v := validator.New()
+		if data.ValidateIdempotencyKey(v, key); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		// read the body so it can be fingerprinted, then put it back for the
+		// handler, using the same 1MiB limit as readJSON()
+		maxBytes := 1_048_576
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxBytes)))
+		if err != nil {
+			app.badRequestResponse(w, r, fmt.Errorf("body must not be larger than %d bytes", maxBytes))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// fingerprint covers the method and path as well, so a key can't be
+		// replayed against a different endpoint
+		fingerprint := sha256.New()
+		fingerprint.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+		fingerprint.Write(body)
+		requestHash := fingerprint.Sum(nil)
+
+		user := app.contextGetUser(r)
+
+		// anonymous callers all share user ID 0, so their keys are scoped to
+		// the client's IP too, otherwise two clients picking the same key
+		// would get each other's responses
+		if user.IsAnon() {
+			key = realip.FromRequest(r) + " " + key
+		}
+
+		// the insert is atomic, so of several concurrent duplicates only one
+		// gets to reserve the key and run the handler
+		reserved, err := app.models.Idempotency.Reserve(key, user.ID, requestHash, idempotencyLockTTL)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !reserved {
+			record, err := app.models.Idempotency.Get(key, user.ID)
+			if err != nil {
+				switch {
+				// expired between reserve and get, let the client retry
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.idempotencyKeyInFlightResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			if !bytes.Equal(record.RequestHash, requestHash) {
+				app.idempotencyKeyMismatchResponse(w, r)
+				return
+			}
+
+			if record.InFlight() {
+				app.idempotencyKeyInFlightResponse(w, r)
+				return
+			}
+
+			// replay the stored response
+			for k, values := range record.Header {
+				w.Header()[k] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(record.StatusCode)
+			w.Write(record.Body)
+			return
+		}
+
+		// release the key if the handler panics, so the client can retry
+		completed := false
+		defer func() {
+			if !completed {
+				err := app.models.Idempotency.Delete(key, user.ID)
+				if err != nil {
+					app.logError(r, err)
+				}
+			}
+		}()
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		// server errors aren't stored, the retry should get another go
+		if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+			return
+		}
+
+		err = app.models.Idempotency.Complete(key, user.ID, rec.status, w.Header().Clone(), rec.body.Bytes(), app.config.idempotency.ttl)
+		if err != nil {
+			// the response has already gone out, so only log it
+			app.logError(r, err)
+			return
+		}
+		completed = true
+	})
+}
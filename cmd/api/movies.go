@@ -10,6 +10,28 @@ import (
 	"github.com/meistens/api_practice/internal/validator"
 )
 
+// permission codes which allow writing movies, movies:write covers every
+// movie, movies:write:own only the ones the user created
+var movieWrite = data.AnyOf(data.Code("movies:write"), data.Code("movies:write:own"))
+
+// check if a user with the given permissions may change a movie
+func canWriteMovie(user *data.User, permissions data.Permissions, movie *data.Movie) bool {
+	if permissions.Include("movies:write") {
+		return true
+	}
+	return permissions.Include("movies:write:own") && movie.CreatedBy != 0 && movie.CreatedBy == user.ID
+}
+
+// moderators (global movies:write) get to see who owns each movie
+func exposeMovieOwners(permissions data.Permissions, movies ...*data.Movie) {
+	if !permissions.Include("movies:write") {
+		return
+	}
+	for _, movie := range movies {
+		movie.ExposeOwner()
+	}
+}
+
 // add createMovieHandler for the POST /v1/movies endpoint
 func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
 	// declare an anon struct to hold info expected to be in the http request body
@@ -30,11 +52,14 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	user := app.contextGetUser(r)
+
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:     input.Title,
+		Year:      input.Year,
+		Runtime:   input.Runtime,
+		Genres:    input.Genres,
+		CreatedBy: user.ID,
 	}
 
 	// init. new validator instance
@@ -54,6 +79,13 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+
+	permissions, err := app.userPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	exposeMovieOwners(permissions, movie)
 	// include location header to let the client know which url they can find
 	// the newly created resource by making an empty http.Header map and using Set()
 	// to include the header
@@ -89,6 +121,13 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	permissions, err := app.userPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	exposeMovieOwners(permissions, movie)
+
 	// create an envelope{"movie": movie} instance and pass it to wrtiejson()
 	// instead of passing the plain movie struct
 	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
@@ -117,6 +156,19 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// movies:write:own holders may only change their own movies
+	user := app.contextGetUser(r)
+
+	permissions, err := app.userPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !canWriteMovie(user, permissions, movie) {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
 	// if request contains a x-expected-version header, verify that the movie
 	// version in the db matches the expected versions specified
 	if r.Header.Get("X-Expected-Version") != "" {
@@ -157,6 +209,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	if input.Genres != nil {
 		movie.Genres = input.Genres
 	}
+	movie.UpdatedBy = user.ID
 
 	// validate
 	v := validator.New()
@@ -176,6 +229,8 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	exposeMovieOwners(permissions, movie)
+
 	// write updated record in a json response
 	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
 	if err != nil {
@@ -191,12 +246,32 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		app.notFoundResponse(w, r)
 		return
 	}
+	user := app.contextGetUser(r)
+
+	permissions, err := app.userPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	// delete movie from db, sending 404 if no matching record
-	err = app.models.Movies.Delete(id)
+	// without global movies:write the delete only goes ahead if the movie
+	// belongs to the user, checked by the same statement so nobody can
+	// take it over in between
+	switch {
+	case permissions.Include("movies:write"):
+		err = app.models.Movies.Delete(id)
+	case permissions.Include("movies:write:own"):
+		err = app.models.Movies.DeleteOwned(id, user.ID)
+	default:
+		err = data.ErrNotOwner
+	}
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrNotOwner):
+			app.notPermittedResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -254,6 +329,13 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	permissions, err := app.userPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	exposeMovieOwners(permissions, movies...)
+
 	// send json response containing movie data
 	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
 	if err != nil {
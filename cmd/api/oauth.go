@@ -0,0 +1,488 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/meistens/api_practice/internal/data"
+	"github.com/meistens/api_practice/internal/validator"
+)
+
+const (
+	// how long an authorization code can wait to be exchanged
+	oauthCodeTTL = 10 * time.Minute
+	// OAuth access tokens aren't refreshable, clients go through the
+	// authorization flow again once they expire
+	oauthAccessTTL = time.Hour
+)
+
+// PKCE code verifiers, RFC 7636 section 4.1
+var pkceVerifierRX = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// check a PKCE code verifier against the S256 challenge sent to the
+// authorization endpoint
+func pkceMatches(verifier, challenge string) bool {
+	hash := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(hash[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// POST /v1/admin/oauth/clients
+// confidential clients get a secret and a service account holding the
+// client's scopes, which is what the client credentials grant acts as
+func (app *application) createOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	client := &data.OAuthClient{
+		Name:         input.Name,
+		RedirectURIs: input.RedirectURIs,
+		Scopes:       data.Permissions(input.Scopes),
+		Confidential: input.Confidential,
+	}
+
+	v := validator.New()
+
+	if data.ValidateOAuthClient(v, client, known); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// confidential clients act with their scopes on their own, so an admin
+	// can only hand out scopes they could grant a user themselves
+	actor, err := app.userPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	for _, scope := range client.Scopes {
+		if !actor.CanDelegate(scope) {
+			app.cannotDelegateResponse(w, r, scope)
+			return
+		}
+	}
+
+	var account *data.User
+	if client.Confidential {
+		account, err = newOAuthServiceAccount(client)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.models.OAuth.NewClient(client, account)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"client": client}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// the service account for a confidential client, with a random address and
+// password nobody knows, OAuth.NewClient() inserts it along with the client
+func newOAuthServiceAccount(client *data.OAuthClient) (*data.User, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	account := &data.User{
+		Name:           client.Name,
+		Email:          "oauth-" + hex.EncodeToString(randomBytes[:8]) + "@clients.invalid",
+		Activated:      true,
+		ServiceAccount: true,
+	}
+
+	err = account.Password.Set(base64.RawURLEncoding.EncodeToString(randomBytes))
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// GET /v1/admin/oauth/clients
+func (app *application) listOAuthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	clients, err := app.models.OAuth.GetAllClients()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"clients": clients}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// DELETE /v1/admin/oauth/clients/:id
+// every code and token issued to the client stops working
+func (app *application) deleteOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.OAuth.DeleteClient(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "oauth client successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// parameters of an authorization request, sent as the query string to
+// GET /v1/oauth/authorize and as JSON to POST /v1/oauth/authorize
+type authorizeRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// check an authorization request, returning the client and the scopes the
+// user can grant it
+// problems with the request are added to v, err is only for server errors
+func (app *application) checkAuthorizeRequest(r *http.Request, req authorizeRequest, v *validator.Validator) (*data.OAuthClient, data.Permissions, error) {
+	v.Check(req.ResponseType == "code", "response_type", "must be code")
+	v.Check(req.ClientID != "", "client_id", "must be provided")
+	// PKCE is required for every client, and only with S256
+	v.Check(req.CodeChallengeMethod == "S256", "code_challenge_method", "must be S256")
+	v.Check(len(req.CodeChallenge) == 43, "code_challenge", "must be a base64url encoded SHA-256 hash")
+	v.Check(len(req.State) <= 500, "state", "must not be more than 500 bytes long")
+
+	if !v.Valid() {
+		return nil, nil, nil
+	}
+
+	client, err := app.models.OAuth.GetClient(req.ClientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("client_id", "unknown client")
+			return nil, nil, nil
+		default:
+			return nil, nil, err
+		}
+	}
+
+	if !client.HasRedirectURI(req.RedirectURI) {
+		v.AddError("redirect_uri", "must be one of the client's registered redirect uris")
+		return nil, nil, nil
+	}
+
+	// OAuth scopes are permission codes, space separated, and default to
+	// everything the client is registered for
+	requested := data.Permissions(strings.Fields(req.Scope))
+	if len(requested) == 0 {
+		requested = client.Scopes
+	}
+	for _, code := range requested {
+		if !client.Scopes.Include(code) {
+			v.AddError("scope", "the client can't request "+code)
+			return nil, nil, nil
+		}
+	}
+
+	// users can only hand over permissions they hold themselves
+	held, err := app.userPermissions(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	granted := data.Permissions{}
+	for _, code := range requested {
+		if held.Include(code) {
+			granted = append(granted, code)
+		}
+	}
+	v.Check(len(granted) > 0, "scope", "you don't hold any of the requested permissions")
+
+	return client, granted, nil
+}
+
+// GET /v1/oauth/authorize
+// the consent step, describes what the client is asking for so the
+// frontend can show it to the user before they approve or deny it
+func (app *application) showAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	req := authorizeRequest{
+		ResponseType:        app.readString(qs, "response_type", ""),
+		ClientID:            app.readString(qs, "client_id", ""),
+		RedirectURI:         app.readString(qs, "redirect_uri", ""),
+		Scope:               app.readString(qs, "scope", ""),
+		State:               app.readString(qs, "state", ""),
+		CodeChallenge:       app.readString(qs, "code_challenge", ""),
+		CodeChallengeMethod: app.readString(qs, "code_challenge_method", ""),
+	}
+
+	v := validator.New()
+
+	client, scopes, err := app.checkAuthorizeRequest(r, req, v)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"authorization": map[string]any{
+		"client":       map[string]string{"client_id": client.ClientID, "name": client.Name},
+		"scopes":       scopes,
+		"redirect_uri": req.RedirectURI,
+	}}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// POST /v1/oauth/authorize
+// the user's answer to the consent step, returns the redirect uri with
+// either an authorization code or an access_denied error for the frontend
+// to send the browser to
+func (app *application) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		authorizeRequest
+		Approve bool `json:"approve"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	client, scopes, err := app.checkAuthorizeRequest(r, input.authorizeRequest, v)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	redirect, err := url.Parse(input.RedirectURI)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	params := redirect.Query()
+
+	if input.Approve {
+		code := &data.OAuthCode{
+			ClientID:      client.ID,
+			UserID:        app.contextGetUser(r).ID,
+			RedirectURI:   input.RedirectURI,
+			Scopes:        scopes,
+			CodeChallenge: input.CodeChallenge,
+		}
+
+		err = app.models.OAuth.NewCode(code, oauthCodeTTL)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		params.Set("code", code.Plaintext)
+	} else {
+		params.Set("error", "access_denied")
+	}
+	if input.State != "" {
+		params.Set("state", input.State)
+	}
+	redirect.RawQuery = params.Encode()
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"redirect_uri": redirect.String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// authenticate the client at the token endpoint, with HTTP basic auth or
+// client_id/client_secret form fields
+// public clients only send their client_id
+func (app *application) authenticateOAuthClient(r *http.Request) (*data.OAuthClient, error) {
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		// basic auth credentials are form encoded first, RFC 6749 section 2.3.1
+		var err error
+		if clientID, err = url.QueryUnescape(clientID); err != nil {
+			return nil, data.ErrRecordNotFound
+		}
+		if secret, err = url.QueryUnescape(secret); err != nil {
+			return nil, data.ErrRecordNotFound
+		}
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	if clientID == "" {
+		return nil, data.ErrRecordNotFound
+	}
+
+	client, err := app.models.OAuth.GetClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if client.Confidential && !client.SecretMatches(secret) {
+		return nil, data.ErrRecordNotFound
+	}
+	if !client.Confidential && secret != "" {
+		return nil, data.ErrRecordNotFound
+	}
+	return client, nil
+}
+
+// POST /v1/oauth/token
+// takes a form encoded body and answers with RFC 6749 style errors, rather
+// than the usual JSON in and out, so standard OAuth libraries work with it
+func (app *application) oauthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "the body must be form encoded")
+		return
+	}
+
+	client, err := app.authenticateOAuthClient(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			w.Header().Set("WWW-Authenticate", "Basic")
+			app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var (
+		userID int64
+		scopes data.Permissions
+	)
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		verifier := r.PostForm.Get("code_verifier")
+		if !pkceVerifierRX.MatchString(verifier) {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "a valid code_verifier must be provided")
+			return
+		}
+
+		// the code is used up even if the rest of the checks fail
+		code, err := app.models.OAuth.ConsumeCode(r.PostForm.Get("code"))
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid or expired authorization code")
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if code.ClientID != client.ID || code.RedirectURI != r.PostForm.Get("redirect_uri") || !pkceMatches(verifier, code.CodeChallenge) {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid or expired authorization code")
+			return
+		}
+
+		userID, scopes = code.UserID, code.Scopes
+
+	case "client_credentials":
+		if !client.Confidential {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "unauthorized_client", "public clients can't use the client credentials grant")
+			return
+		}
+
+		scopes = data.Permissions(strings.Fields(r.PostForm.Get("scope")))
+		if len(scopes) == 0 {
+			scopes = client.Scopes
+		}
+		for _, code := range scopes {
+			if !client.Scopes.Include(code) {
+				app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_scope", "the client can't request "+code)
+				return
+			}
+		}
+
+		userID = client.UserID
+
+	default:
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be authorization_code or client_credentials")
+		return
+	}
+
+	token, err := app.models.Tokens.NewOAuth(userID, oauthAccessTTL, client.ID, scopes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+
+	env := envelope{
+		"access_token": token.Plaintext,
+		"token_type":   "Bearer",
+		"expires_in":   int(oauthAccessTTL.Seconds()),
+		"scope":        strings.Join(scopes, " "),
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
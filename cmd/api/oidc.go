@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/meistens/api_practice/internal/data"
+	"github.com/meistens/api_practice/internal/oidc"
+	"github.com/meistens/api_practice/internal/validator"
+)
+
+// how long the user has to get through the provider's login page
+const oidcLoginTTL = 10 * time.Minute
+
+// GET /v1/oidc/login
+// start a login through the external provider, the client sends the
+// user's browser to the returned URL
+func (app *application) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	login, err := app.models.Identities.NewLogin(oidcLoginTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"authorization_url": app.oidc.AuthCodeURL(login.State, login.Nonce, login.CodeVerifier),
+		"state":             login.State,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// GET /v1/oidc/callback
+// where the provider sends the browser back to, the code is exchanged for
+// an ID token, the user it belongs to is found (or created) and logged in
+// the same way as with a password
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+
+	// the user cancelled, or the provider refused them
+	if providerErr := app.readString(qs, "error", ""); providerErr != "" {
+		app.errorResponse(w, r, http.StatusUnauthorized, "login was not completed at the identity provider: "+providerErr)
+		return
+	}
+
+	state := app.readString(qs, "state", "")
+	code := app.readString(qs, "code", "")
+
+	v := validator.New()
+
+	v.Check(state != "", "state", "must be provided")
+	v.Check(code != "", "code", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// the state has to be one we issued and can only be used once
+	login, err := app.models.Identities.ConsumeLogin(state)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("state", "invalid or expired login state")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	claims, err := app.oidc.Exchange(ctx, code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrExchangeFailed), errors.Is(err, oidc.ErrInvalidIDToken):
+			app.logger.PrintInfo("oidc login rejected", map[string]string{"error": err.Error()})
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.oidcUser(claims)
+	if err != nil {
+		switch {
+		case errors.Is(err, errOIDCUnverifiedEmail):
+			app.errorResponse(w, r, http.StatusForbidden, "your identity provider account has no verified email address")
+		case errors.Is(err, errOIDCServiceAccount):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+var (
+	errOIDCUnverifiedEmail = errors.New("oidc: email not verified")
+	errOIDCServiceAccount  = errors.New("oidc: email belongs to a service account")
+)
+
+// find the user for a provider account
+// accounts seen before are already linked, otherwise they're linked to the
+// user with the same (verified) email address, or a new user is created
+// with the default role
+func (app *application) oidcUser(claims *oidc.Claims) (*data.User, error) {
+	user, err := app.models.Identities.GetUser(claims.Issuer, claims.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	// an unverified address could belong to anyone, so it's not enough to
+	// take over or create an account
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, errOIDCUnverifiedEmail
+	}
+
+	user, err = app.models.Users.GetByEmail(claims.Email)
+	switch {
+	case err == nil:
+		if user.ServiceAccount {
+			return nil, errOIDCServiceAccount
+		}
+		// the provider has verified the address, which is all activation
+		// does
+		if !user.Activated {
+			user.Activated = true
+			err = app.models.Users.Update(user)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+	case errors.Is(err, data.ErrRecordNotFound):
+		user, err = app.provisionOIDCUser(claims)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, err
+	}
+
+	err = app.models.Identities.Link(user.ID, claims.Issuer, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// create a user for someone logging in through the provider for the first
+// time, they get a random password nobody knows and can set a real one
+// through the password reset flow if they ever need it
+func (app *application) provisionOIDCUser(claims *oidc.Claims) (*data.User, error) {
+	name := claims.Name
+	if name == "" {
+		name = claims.Email
+	}
+
+	user := &data.User{
+		Name:      name,
+		Email:     claims.Email,
+		Activated: true,
+	}
+
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = user.Password.Set(base64.RawURLEncoding.EncodeToString(randomBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	// whatever the provider sends has to pass the same checks as a
+	// registration
+	v := validator.New()
+	if data.ValidateUser(v, user); !v.Valid() {
+		return nil, fmt.Errorf("oidc: provider claims fail user validation: %v", v.Errors)
+	}
+
+	// same default role as registerUserHandler
+	roleIDs, err := app.newUserRoles()
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Users.Insert(user, roleIDs...)
+	if err != nil {
+		return nil, err
+	}
+
+	app.logger.PrintInfo("user provisioned from oidc login", map[string]string{
+		"user_id": strconv.FormatInt(user.ID, 10),
+		"issuer":  claims.Issuer,
+	})
+	return user, nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/meistens/api_practice/internal/data"
+	"github.com/meistens/api_practice/internal/validator"
+)
+
+// the roles a new user starts with, just the -default-role if there is one
+// they're inserted along with the user by Users.Insert()
+func (app *application) newUserRoles() ([]int64, error) {
+	if app.config.roles.defaultRole == "" {
+		return nil, nil
+	}
+
+	role, err := app.models.Roles.GetByName(app.config.roles.defaultRole)
+	if err != nil {
+		return nil, fmt.Errorf("default role %q: %w", app.config.roles.defaultRole, err)
+	}
+	return []int64{role.ID}, nil
+}
+
+// look up the role named by the :id parameter, sending the error response
+// itself and returning nil if there isn't one
+func (app *application) readRole(w http.ResponseWriter, r *http.Request) *data.Role {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	role, err := app.models.Roles.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return role
+}
+
+// GET /v1/admin/roles
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// POST /v1/admin/roles
+func (app *application) createRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	role := &data.Role{
+		Name:        input.Name,
+		Description: input.Description,
+		Permissions: input.Permissions,
+	}
+
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateRole(v, role, known); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Roles.Insert(role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRole):
+			v.AddError("name", "a role with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/admin/roles/%d", role.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"role": role}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// GET /v1/admin/roles/:id
+func (app *application) showRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role := app.readRole(w, r)
+	if role == nil {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// PATCH /v1/admin/roles/:id
+// permissions, when sent, replace the role's whole set
+func (app *application) updateRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role := app.readRole(w, r)
+	if role == nil {
+		return
+	}
+
+	var input struct {
+		Name        *string  `json:"name"`
+		Description *string  `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if input.Name != nil {
+		// new registrations look the default role up by name
+		if role.Name == app.config.roles.defaultRole && *input.Name != role.Name {
+			v.AddError("name", "the default role can't be renamed")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+		role.Name = *input.Name
+	}
+	if input.Description != nil {
+		role.Description = *input.Description
+	}
+	if input.Permissions != nil {
+		role.Permissions = input.Permissions
+	}
+
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if data.ValidateRole(v, role, known); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Roles.Update(role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRole):
+			v.AddError("name", "a role with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// signed tokens carry the permissions they were issued with, holders of
+	// the role aren't tracked there so everyone gets new ones
+	if input.Permissions != nil {
+		err = app.revokeSignedTokensForUser(0)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// DELETE /v1/admin/roles/:id
+// users holding the role lose it, and the permissions that came with it
+func (app *application) deleteRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role := app.readRole(w, r)
+	if role == nil {
+		return
+	}
+
+	if role.Name == app.config.roles.defaultRole {
+		app.badRequestResponse(w, r, errors.New("the default role can't be deleted"))
+		return
+	}
+
+	err := app.models.Roles.Delete(role.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.revokeSignedTokensForUser(0)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "role successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// PUT /v1/admin/users/:id/roles/:name
+// give a user a role, giving one they already hold does nothing
+func (app *application) assignRoleHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeRole(w, r, true)
+}
+
+// DELETE /v1/admin/users/:id/roles/:name
+// take a role away from a user
+func (app *application) unassignRoleHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeRole(w, r, false)
+}
+
+func (app *application) changeRole(w http.ResponseWriter, r *http.Request, assign bool) {
+	user := app.readUser(w, r)
+	if user == nil {
+		return
+	}
+
+	role, err := app.models.Roles.GetByName(httprouter.ParamsFromContext(r.Context()).ByName("name"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the seeded admin role carries *, so users:admin alone would otherwise
+	// be enough to hand anyone every permission, as with changePermission()
+	actor, err := app.userPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	for _, entry := range role.Permissions {
+		if !actor.CanDelegate(entry) {
+			app.cannotDelegateResponse(w, r, entry)
+			return
+		}
+	}
+
+	// admins can't lock themselves out of the admin API by giving up the
+	// role their users:admin comes from
+	if !assign && user.ID == app.contextGetUser(r).ID {
+		held, err := app.models.Permissions.GetAllUserPermsWithoutRole(user.ID, role.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !held.Include("users:admin") {
+			app.badRequestResponse(w, r, errors.New("you can't take your own users:admin permission away"))
+			return
+		}
+	}
+
+	if assign {
+		err = app.models.Roles.AddForUser(user.ID, role.ID)
+	} else {
+		err = app.models.Roles.RemoveForUser(user.ID, role.ID)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// their signed tokens carry the permissions they had before
+	err = app.revokeSignedTokensForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo("user roles changed by admin", map[string]string{
+		"user_id":  strconv.FormatInt(user.ID, 10),
+		"admin_id": strconv.FormatInt(app.contextGetUser(r).ID, 10),
+		"role":     role.Name,
+		"assigned": strconv.FormatBool(assign),
+	})
+
+	eventType := data.EventRoleUnassigned
+	if assign {
+		eventType = data.EventRoleAssigned
+	}
+	app.recordSecurityEvent(r, eventType, user.ID, map[string]string{"role": role.Name})
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
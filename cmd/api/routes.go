@@ -22,19 +22,108 @@ func (app *application) routes() http.Handler {
 
 	// Use the requirePermission() middleware on each of the /v1/movies** endpoints,
 	// passing in the required permission code as the first parameter.
+	// movies:write:own holders get through to the write handlers too, which
+	// then limit them to the movies they created
 	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermissions(movieWrite, app.idempotent(app.createMovieHandler)))
 	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermissions(movieWrite, app.updateMovieHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermissions(movieWrite, app.deleteMovieHandler))
+
+	// batch movie operations, permissions are checked per operation
+	router.HandlerFunc(http.MethodPost, "/v1/batch", app.requireActivatedUser(app.batchHandler))
+
+	// catalogue stats
+	router.HandlerFunc(http.MethodGet, "/v1/stats/movies", app.requirePermission("movies:read", app.movieStatsHandler))
 
 	// updated
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/unlocked", app.unlockUserHandler)
 	// users
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/users", app.idempotent(app.registerUserHandler))
+
+	// profile of the authenticated user
+	// OAuth access tokens are turned away from all of these
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireUserSession(app.showCurrentUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireUserSession(app.updateCurrentUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireUserSession(app.deleteCurrentUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/export", app.requireUserSession(app.exportCurrentUserHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/password", app.requireUserSession(app.changeCurrentUserPassHandler))
+
+	// email change, confirmation only needs the token sent to the new address
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/email", app.requireUserSession(app.requestEmailChangeHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/email", app.confirmEmailChangeHandler)
+
+	// two-factor authentication
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/2fa/totp", app.requireActivatedUser(app.requireUserSession(app.enrolTOTPHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/2fa/totp", app.requireActivatedUser(app.requireUserSession(app.confirmTOTPHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/2fa/totp", app.requireActivatedUser(app.requireUserSession(app.disableTOTPHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/2fa/recovery-codes", app.requireActivatedUser(app.requireUserSession(app.newRecoveryCodesHandler)))
 
 	// authentication
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/mfa", app.createMFATokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthTokenHandler)
+
+	// passwordless login through a token sent by email
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link", app.createMagicLinkHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link/redeem", app.redeemMagicLinkHandler)
+
+	// login through the external OpenID Connect provider, 404 unless
+	// -oidc-issuer is set
+	router.HandlerFunc(http.MethodGet, "/v1/oidc/login", app.oidcLoginHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/oidc/callback", app.oidcCallbackHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthUser(app.deleteAuthTokenHandler))
+
+	// sessions
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireUserSession(app.listSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions", app.requireUserSession(app.deleteAllSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireUserSession(app.deleteSessionHandler))
+
+	// audit log of logins, password and permission changes and revoked
+	// tokens, users see the events about their own account
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/security-events", app.requireUserSession(app.listCurrentUserSecurityEventsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/security-events", app.requirePermission("users:admin", app.listSecurityEventsHandler))
+
+	// service accounts and their api keys
+	router.HandlerFunc(http.MethodPost, "/v1/admin/service-accounts", app.requirePermission("api_keys:admin", app.createServiceAccountHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/service-accounts/:id/api-keys", app.requirePermission("api_keys:admin", app.listAPIKeysHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/service-accounts/:id/api-keys", app.requirePermission("api_keys:admin", app.createAPIKeyHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/api-keys/:id", app.requirePermission("api_keys:admin", app.deleteAPIKeyHandler))
+
+	// user management
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("users:admin", app.listUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requirePermission("users:admin", app.showUserHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/activated", app.requirePermission("users:admin", app.adminActivateUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/activated", app.requirePermission("users:admin", app.adminDeactivateUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/password-reset", app.requirePermission("users:admin", app.forcePassResetHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/permissions/:code", app.requirePermission("users:admin", app.grantPermissionHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions/:code", app.requirePermission("users:admin", app.revokePermissionHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/suspended", app.requirePermission("users:admin", app.suspendUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/suspended", app.requirePermission("users:admin", app.unsuspendUserHandler))
+
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/roles/:name", app.requirePermission("users:admin", app.assignRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles/:name", app.requirePermission("users:admin", app.unassignRoleHandler))
+
+	// roles
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requirePermission("roles:admin", app.listRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/roles", app.requirePermission("roles:admin", app.createRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles/:id", app.requirePermission("roles:admin", app.showRoleHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/roles/:id", app.requirePermission("roles:admin", app.updateRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/roles/:id", app.requirePermission("roles:admin", app.deleteRoleHandler))
+
+	// locked out accounts and login history
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/lockout", app.requirePermission("users:admin", app.adminUnlockUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/login-attempts", app.requirePermission("users:admin", app.listLoginAttemptsHandler))
+
+	// oauth, the authorize endpoints need a logged in user (not another
+	// oauth token), the token endpoint authenticates the client itself
+	router.HandlerFunc(http.MethodGet, "/v1/oauth/authorize", app.requireActivatedUser(app.requireUserSession(app.showAuthorizeHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/authorize", app.requireActivatedUser(app.requireUserSession(app.authorizeHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/token", app.oauthTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/admin/oauth/clients", app.requirePermission("oauth_clients:admin", app.createOAuthClientHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/oauth/clients", app.requirePermission("oauth_clients:admin", app.listOAuthClientsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/oauth/clients/:id", app.requirePermission("oauth_clients:admin", app.deleteOAuthClientHandler))
 
 	// PUT /v1/users/password endpoint
 	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPassHandler)
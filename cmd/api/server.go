@@ -28,6 +28,18 @@ func (app *application) serve() error {
 	// start profiing server with shared context
 	_ = app.startProfilingServer(ctx)
 
+	// purge accounts whose deletion grace period is over
+	app.startAccountPurger(ctx)
+
+	// delete expired tokens
+	app.startTokenReaper(ctx)
+
+	// keep the signed token denylist in sync
+	app.startDenylistRefresher(ctx)
+
+	// drop cached tokens and permissions changed on other instances
+	app.startAuthCacheListener(ctx)
+
 	// create shutdownerror channel
 	shutdownError := make(chan error)
 
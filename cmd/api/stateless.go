@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/meistens/api_practice/internal/data"
+	"github.com/meistens/api_practice/internal/jwt"
+)
+
+// how often the in-memory denylist is reloaded from postgres when no
+// change has been announced, a revoked signed token stays usable on other
+// instances for at most this long if the announcement is lost
+const denylistRefreshInterval = 30 * time.Second
+
+// in-memory copy of the token_denylist and token_denylist_users tables,
+// so signed tokens can be checked without a query per request
+type tokenDenylist struct {
+	mu      sync.RWMutex
+	entries map[string]time.Time
+	// when each user's signed tokens were last revoked, 0 for everyone's
+	users map[int64]time.Time
+}
+
+func newTokenDenylist() *tokenDenylist {
+	return &tokenDenylist{
+		entries: make(map[string]time.Time),
+		users:   make(map[int64]time.Time),
+	}
+}
+
+func (d *tokenDenylist) contains(jti string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	_, found := d.entries[jti]
+	return found
+}
+
+func (d *tokenDenylist) add(jti string, expiry time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.entries[jti] = expiry
+}
+
+// the second up to which tokens issued to the user are revoked, 0 if none
+// are, token iat claims only have whole seconds so a token issued in the
+// same second as the revocation is revoked too
+func (d *tokenDenylist) revokedUntil(userID int64) int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var until int64
+	for _, id := range []int64{userID, 0} {
+		if revokedAt, found := d.users[id]; found && revokedAt.Unix() > until {
+			until = revokedAt.Unix()
+		}
+	}
+	return until
+}
+
+func (d *tokenDenylist) revokeUser(userID int64, revokedAt time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if revokedAt.After(d.users[userID]) {
+		d.users[userID] = revokedAt
+	}
+}
+
+func (d *tokenDenylist) replace(entries map[string]time.Time, users map[int64]time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.entries = entries
+	d.users = users
+}
+
+// denylist entry for every signed token issued to a token family, token
+// IDs are base64 so they can't clash with it
+func familyDenylistID(family string) string {
+	return "family:" + family
+}
+
+// start a background goroutine which keeps the in-memory denylist in
+// sync with postgres, reloading it whenever another instance announces a
+// change and every denylistRefreshInterval in case one was missed
+// it stops when ctx is cancelled, does nothing unless signing keys are
+// configured
+func (app *application) startDenylistRefresher(ctx context.Context) {
+	if app.signingKeys == nil {
+		return
+	}
+
+	listener := pq.NewListener(app.config.db.dsn, 10*time.Second, time.Minute, func(_ pq.ListenerEventType, err error) {
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"component": "denylist_refresher",
+			})
+		}
+	})
+
+	err := listener.Listen(data.DenylistChannel)
+	if err != nil {
+		// the periodic reload still picks changes up
+		app.logger.PrintError(err, map[string]string{
+			"component": "denylist_refresher",
+		})
+	}
+
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		defer listener.Close()
+
+		// recover any panic so the refresher can't take the server down
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.PrintError(fmt.Errorf("%s", err), map[string]string{
+					"component": "denylist_refresher",
+				})
+			}
+		}()
+
+		ticker := time.NewTicker(denylistRefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			err := app.reloadDenylist()
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{
+					"component": "denylist_refresher",
+				})
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-listener.Notify:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (app *application) reloadDenylist() error {
+	entries, err := app.models.Denylist.GetAllActive()
+	if err != nil {
+		return err
+	}
+
+	// a revocation older than the access token lifetime only covers
+	// tokens which have expired by now
+	users, err := app.models.Denylist.GetRevokedUsers(time.Now().Add(-app.config.auth.accessTTL))
+	if err != nil {
+		return err
+	}
+
+	app.denylist.replace(entries, users)
+	return nil
+}
+
+// returned by issueAccessToken for a suspended user, a refresh which raced
+// the suspension would otherwise get a token dated after the revocation
+var errAccountSuspended = errors.New("account suspended")
+
+// in signed mode, replace the access token from a new token pair, which
+// wasn't stored, with a signed one carrying the user's activation status
+// and permissions
+// in opaque mode the token is returned as it is
+func (app *application) issueAccessToken(access *data.Token) (*data.Token, error) {
+	if app.config.auth.mode != "signed" {
+		return access, nil
+	}
+
+	user, err := app.models.Users.Get(access.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user.IsSuspended() {
+		return nil, errAccountSuspended
+	}
+
+	permissions, err := app.models.Permissions.GetAllUserPerms(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwt.Claims{
+		Subject:     user.ID,
+		IssuedAt:    time.Now().Unix(),
+		Expiry:      access.Expiry.Unix(),
+		Activated:   user.Activated,
+		MFA:         user.TwoFactorEnabled,
+		Permissions: permissions,
+	}
+	claims.SetFamily(access.FamilyID)
+
+	// a token issued in the same second as a revocation, e.g. on the
+	// refresh straight after one, would count as revoked
+	if until := app.denylist.revokedUntil(user.ID); claims.IssuedAt <= until {
+		claims.IssuedAt = until + 1
+	}
+
+	signed, err := app.signingKeys.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.Token{
+		Plaintext: signed,
+		UserID:    user.ID,
+		Expiry:    access.Expiry,
+		Scope:     data.ScopeAuthentication,
+		FamilyID:  access.FamilyID,
+	}, nil
+}
+
+// verify a signed bearer token and return the (partial) user and the
+// permissions it carries, without touching the db
+// the token is refused if it's been revoked on its own, along with its
+// session, or along with every token issued to the user before some point
+func (app *application) authenticateSigned(token string) (*data.User, data.Permissions, error) {
+	claims, err := app.signingKeys.Verify(token, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if app.denylist.contains(claims.ID) {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+	if claims.Family != "" && app.denylist.contains(familyDenylistID(claims.Family)) {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+	if claims.IssuedAt <= app.denylist.revokedUntil(claims.Subject) {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+
+	user := &data.User{
+		ID:               claims.Subject,
+		Activated:        claims.Activated,
+		TwoFactorEnabled: claims.MFA,
+	}
+	return user, data.Permissions(claims.Permissions), nil
+}
+
+// revoke a signed token before it expires, along with the session it
+// was issued for and the session's other signed tokens
+func (app *application) revokeSignedToken(token string) error {
+	claims, err := app.signingKeys.Verify(token, time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = app.models.Denylist.Insert(claims.ID, claims.ExpiresAt())
+	if err != nil {
+		return err
+	}
+	// no need to wait for the next refresh on this instance
+	app.denylist.add(claims.ID, claims.ExpiresAt())
+
+	if familyID := claims.FamilyID(); familyID != nil {
+		err = app.revokeSignedFamily(familyID)
+		if err != nil {
+			return err
+		}
+		return app.models.Sessions.DeleteForFamily(familyID)
+	}
+	return nil
+}
+
+// revoke the signed tokens issued for a token family, for when its session
+// ends some other way than logging out with one of them
+// does nothing unless signing keys are configured
+func (app *application) revokeSignedFamily(familyID []byte) error {
+	if app.signingKeys == nil || familyID == nil {
+		return nil
+	}
+
+	// every token in the family has expired by then
+	id := familyDenylistID(hex.EncodeToString(familyID))
+	expiry := time.Now().Add(app.config.auth.accessTTL)
+
+	err := app.models.Denylist.Insert(id, expiry)
+	if err != nil {
+		return err
+	}
+	app.denylist.add(id, expiry)
+	return nil
+}
+
+// revoke every signed token issued to a user so far, or to everyone for
+// userID 0, for when what they carry is out of date or the user's sessions
+// have been ended
+// clients with a refresh token left get a new token with the current
+// claims, does nothing unless signing keys are configured
+func (app *application) revokeSignedTokensForUser(userID int64) error {
+	if app.signingKeys == nil {
+		return nil
+	}
+
+	revokedAt, err := app.models.Denylist.RevokeUser(userID)
+	if err != nil {
+		return err
+	}
+	app.denylist.revokeUser(userID, revokedAt)
+	return nil
+}
+
+// signed tokens only carry the user ID and activation status, so handlers
+// that need the full record (name, email, password hash, version) load it
+// through this rather than using contextGetUser() directly
+func (app *application) currentUser(r *http.Request) (*data.User, error) {
+	user := app.contextGetUser(r)
+
+	if !app.contextIsStateless(r) {
+		return user, nil
+	}
+	return app.models.Users.Get(user.ID)
+}
+
+// permissions for the request's user, taken from a signed token or API key
+// when there is one and from the db otherwise
+// codes under the 2FA policy are left out until the user has enabled it,
+// grantedPermissions() has the full set
+func (app *application) userPermissions(r *http.Request) (data.Permissions, error) {
+	permissions, err := app.grantedPermissions(r)
+	if err != nil {
+		return nil, err
+	}
+	return app.mfaPermissions(r, permissions), nil
+}
+
+func (app *application) grantedPermissions(r *http.Request) (data.Permissions, error) {
+	if permissions, ok := app.contextGetPermissions(r); ok {
+		return permissions, nil
+	}
+	return app.models.Permissions.GetAllUserPerms(app.contextGetUser(r).ID)
+}
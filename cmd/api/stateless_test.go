@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meistens/api_practice/internal/jwt"
+)
+
+func TestAuthenticateSignedRevocation(t *testing.T) {
+	key, err := jwt.ParseKey("k1:HS256:" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := jwt.NewKeySet(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	issued := now.Add(-time.Minute)
+
+	sign := func(t *testing.T, subject int64, family []byte) (string, *jwt.Claims) {
+		t.Helper()
+
+		claims := jwt.Claims{Subject: subject, IssuedAt: issued.Unix(), Expiry: now.Add(time.Hour).Unix()}
+		claims.SetFamily(family)
+
+		token, err := keys.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := keys.Verify(token, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token, parsed
+	}
+
+	tests := []struct {
+		name   string
+		revoke func(d *tokenDenylist, claims *jwt.Claims)
+		want   error
+	}{
+		{"not revoked", func(d *tokenDenylist, claims *jwt.Claims) {}, nil},
+		{"token", func(d *tokenDenylist, claims *jwt.Claims) {
+			d.add(claims.ID, claims.ExpiresAt())
+		}, jwt.ErrInvalidToken},
+		{"family", func(d *tokenDenylist, claims *jwt.Claims) {
+			d.add(familyDenylistID(claims.Family), claims.ExpiresAt())
+		}, jwt.ErrInvalidToken},
+		{"other family", func(d *tokenDenylist, claims *jwt.Claims) {
+			d.add(familyDenylistID("0000"), claims.ExpiresAt())
+		}, nil},
+		{"user after issue", func(d *tokenDenylist, claims *jwt.Claims) {
+			d.revokeUser(claims.Subject, issued.Add(time.Second))
+		}, jwt.ErrInvalidToken},
+		{"user in the same second", func(d *tokenDenylist, claims *jwt.Claims) {
+			d.revokeUser(claims.Subject, time.Unix(claims.IssuedAt, int64(500*time.Millisecond)))
+		}, jwt.ErrInvalidToken},
+		{"user before issue", func(d *tokenDenylist, claims *jwt.Claims) {
+			d.revokeUser(claims.Subject, issued.Add(-time.Second))
+		}, nil},
+		{"other user", func(d *tokenDenylist, claims *jwt.Claims) {
+			d.revokeUser(claims.Subject+1, now)
+		}, nil},
+		{"everyone", func(d *tokenDenylist, claims *jwt.Claims) {
+			d.revokeUser(0, now)
+		}, jwt.ErrInvalidToken},
+		{"older revocation doesn't win", func(d *tokenDenylist, claims *jwt.Claims) {
+			d.revokeUser(claims.Subject, now)
+			d.revokeUser(claims.Subject, issued.Add(-time.Hour))
+		}, jwt.ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{signingKeys: keys, denylist: newTokenDenylist()}
+
+			token, claims := sign(t, 7, []byte{1, 2, 3, 4})
+			tt.revoke(app.denylist, claims)
+
+			user, _, err := app.authenticateSigned(token)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err == nil && user.ID != 7 {
+				t.Errorf("user ID = %d, want 7", user.ID)
+			}
+		})
+	}
+}
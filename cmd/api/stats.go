@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/meistens/api_practice/internal/data"
+)
+
+// upper bound on the number of distinct filter combinations kept in the
+// stats cache, so arbitrary query strings can't grow it without limit
+const statsCacheMaxEntries = 1000
+
+// in-memory cache for catalogue stats, keyed by the request filters
+type statsCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]statsCacheEntry
+}
+
+type statsCacheEntry struct {
+	stats   *data.MovieStats
+	expires time.Time
+}
+
+func newStatsCache(ttl time.Duration) *statsCache {
+	return &statsCache{
+		ttl:     ttl,
+		entries: make(map[string]statsCacheEntry),
+	}
+}
+
+// return the cached stats for a key if present and not yet expired
+func (c *statsCache) get(key string) (*data.MovieStats, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.entries[key]
+	if !found || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.stats, true
+}
+
+// store stats for a key, dropping expired entries first if the cache is full
+func (c *statsCache) set(key string, stats *data.MovieStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= statsCacheMaxEntries {
+		now := time.Now()
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// still full, start over rather than track usage order
+		if len(c.entries) >= statsCacheMaxEntries {
+			c.entries = make(map[string]statsCacheEntry)
+		}
+	}
+
+	c.entries[key] = statsCacheEntry{stats: stats, expires: time.Now().Add(c.ttl)}
+}
+
+// GET /v1/stats/movies, accepts the same title/genres filters as
+// listMoviesHandler
+func (app *application) movieStatsHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	title := app.readString(qs, "title", "")
+	genres := app.readCSV(qs, "genres", []string{})
+
+	// cache key built from the filter values, quoted so a title holding
+	// a separator can't be mistaken for another title and genres
+	key := fmt.Sprintf("%q %q", title, genres)
+
+	stats, found := app.statsCache.get(key)
+	if !found {
+		var err error
+		stats, err = app.models.Stats.GetMovieStats(title, genres)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.statsCache.set(key, stats)
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"stats": stats}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
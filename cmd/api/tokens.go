@@ -3,10 +3,13 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/meistens/api_practice/internal/data"
+	"github.com/meistens/api_practice/internal/jwt"
 	"github.com/meistens/api_practice/internal/validator"
+	"github.com/tomasen/realip"
 )
 
 func (app *application) createAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
@@ -33,43 +36,224 @@ func (app *application) createAuthTokenHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	// clients which keep getting it wrong are slowed down before the
+	// password is even looked at
+	ip := realip.FromRequest(r)
+
+	wait, err := app.ipLoginDelay(ip, time.Now())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if wait > 0 {
+		app.recordLoginAttempt(0, input.Email, ip, data.LoginThrottled)
+		app.tooManyLoginAttemptsResponse(w, r, wait, "too many failed login attempts from your network, please try again later")
+		return
+	}
+
 	// lookup user record based on mail address
 	// if no matches, invalid credentials and send a 401
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			app.invalidCredentialsResponse(w, r)
+			app.recordLoginAttempt(0, input.Email, ip, data.LoginInvalidCredentials)
+			app.recordSecurityEvent(r, data.EventLoginFailed, 0, map[string]string{
+				"reason": "unknown_email",
+				"email":  input.Email,
+			})
+			app.rejectLoginAsFailure(w, r, input.Password)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
+	// service accounts only authenticate with API keys
+	if user.ServiceAccount {
+		app.recordLoginAttempt(user.ID, input.Email, ip, data.LoginInvalidCredentials)
+		app.recordSecurityEvent(r, data.EventLoginFailed, user.ID, map[string]string{"reason": "service_account"})
+		app.rejectLoginAsFailure(w, r, input.Password)
+		return
+	}
+	// an account backing off or locked isn't tried at all, even with the
+	// right password
+	lockout, err := app.models.LoginAttempts.GetLockout(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if now := time.Now(); lockout.Active(now) {
+		app.recordLoginAttempt(user.ID, input.Email, ip, data.LoginLocked)
+		app.recordSecurityEvent(r, data.EventLoginFailed, user.ID, map[string]string{"reason": "locked"})
+
+		// a lockout only ever happens to an account which exists, the owner
+		// is emailed when it's locked for good
+		if !app.config.auth.revealAccounts {
+			app.rejectLogin(w, r, input.Password)
+			return
+		}
+		app.accountLockedResponse(w, r, lockout, now)
+		return
+	}
 	// check if the provided password matches the actual password for the user
-	match, err := user.Password.Matches(input.Password)
+	match, outdated, err := user.Password.Matches(input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 	// if password doesn't match, invalid creds
 	if !match {
+		app.recordLoginAttempt(user.ID, input.Email, ip, data.LoginInvalidCredentials)
+		app.recordSecurityEvent(r, data.EventLoginFailed, user.ID, map[string]string{"reason": "invalid_credentials"})
+
+		err = app.recordLoginFailure(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
-	// generate new token if it matches
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+
+	// the password was right, so start counting failures afresh
+	if lockout.Failures > 0 {
+		err = app.models.LoginAttempts.ClearLockout(user.ID)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	app.recordLoginAttempt(user.ID, input.Email, ip, data.LoginSuccess)
+
+	// this is the only time we have the plaintext, so hashes made with
+	// bcrypt or old argon2id parameters are upgraded here
+	if outdated {
+		app.rehashPassword(user, input.Password)
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// turn a login down without checking the password, in the time checking
+// it would have taken so the response doesn't say whether there's a
+// usable account behind the email address
+func (app *application) rejectLogin(w http.ResponseWriter, r *http.Request, plaintext string) {
+	if !app.config.auth.revealAccounts {
+		data.SimulatePasswordMatch(plaintext)
+	}
+	app.invalidCredentialsResponse(w, r)
+}
+
+// reject a login which never gets as far as the account's lockout, for an
+// unknown email address or a service account, doing the same database
+// work as a wrong password would
+func (app *application) rejectLoginAsFailure(w http.ResponseWriter, r *http.Request, plaintext string) {
+	if !app.config.auth.revealAccounts {
+		_, err := app.models.LoginAttempts.GetLockout(0)
+		if err == nil {
+			data.SimulatePasswordMatch(plaintext)
+			err = app.models.LoginAttempts.SimulateFailure()
+		}
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	app.invalidCredentialsResponse(w, r)
+}
+
+// replace a user's outdated password hash, the login goes ahead even if
+// this fails since the old hash still works
+func (app *application) rehashPassword(user *data.User, plaintext string) {
+	err := user.Password.Set(plaintext)
+	if err == nil {
+		err = app.models.Users.Update(user)
+	}
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{
+			"component": "password_rehash",
+			"user_id":   strconv.FormatInt(user.ID, 10),
+		})
+	}
+}
+
+// finish the first login step, which is all there is unless the user has
+// 2FA enabled, suspended users get no further
+// with 2FA enabled they only get a short-lived mfa-pending token, which is
+// exchanged along with a code at POST /v1/tokens/mfa
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	if user.IsSuspended() {
+		app.accountSuspendedResponse(w, r)
+		return
+	}
+
+	if user.TwoFactorEnabled {
+		mfaToken, err := app.models.Tokens.New(user.ID, mfaPendingTTL, data.ScopeMFAPending)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"mfa_required": true, "mfa_token": mfaToken}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.startSession(w, r, user)
+}
+
+// finish logging a user in once they're fully authenticated, issuing an
+// access/refresh token pair for a new session and sending it with a 201
+func (app *application) startSession(w http.ResponseWriter, r *http.Request, user *data.User) {
+	// logging in during the deletion grace period cancels the deletion
+	if user.DeletionScheduledAt != nil {
+		err := app.models.Users.CancelDeletion(user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.logger.PrintInfo("account deletion cancelled", map[string]string{
+			"user_id": strconv.FormatInt(user.ID, 10),
+		})
+	}
+
+	// generate a new short-lived access token and a refresh token which can
+	// be exchanged for new ones at POST /v1/tokens/refresh
+	client := data.SessionClient{IP: realip.FromRequest(r), UserAgent: r.UserAgent()}
+
+	token, refreshToken, err := app.models.Tokens.NewPair(user.ID, app.config.auth.accessTTL, app.config.auth.refreshTTL, client, app.config.auth.mode == "signed")
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	//encode token in JSON and send in the response along with 201
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+
+	// swapped for a signed token in signed mode, where the opaque one was
+	// never stored
+	token, err = app.issueAccessToken(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, errAccountSuspended):
+			app.accountSuspendedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.recordSecurityEvent(r, data.EventLogin, user.ID, nil)
+
+	//encode tokens in JSON and send in the response along with 201
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refreshToken}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
 // generate password reset token, to be sent to user mail address
+// the response doesn't say whether the address has an account, the lookup
+// happens in the background so the timing doesn't tell either, and what
+// became of the request goes in the security log
 func (app *application) createPassResetHandler(w http.ResponseWriter, r *http.Request) {
 	// parse and validate user email address
 	var input struct {
@@ -89,31 +273,84 @@ func (app *application) createPassResetHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	// retieve corresponding user record for the email address
-	// if not found, return an error message to the client
-	user, err := app.models.Users.GetByEmail(input.Email)
-	if err != nil {
-		switch {
-		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("email", "no matching email address found")
-			app.failedValidationResponse(w, r, v.Errors)
-		default:
+	if !app.config.auth.revealAccounts {
+		// the request is finished with by the time this runs, so take what
+		// the security event needs from it now
+		info := app.requestInfo(r)
+
+		app.background(func() {
+			_, err := app.sendPassResetToken(info, input.Email)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{
+					"component": "password_reset",
+				})
+			}
+		})
+
+		env := envelope{"message": "if an activated account exists for this email address, password reset instructions will be sent to it"}
+
+		err = app.writeJSON(w, http.StatusAccepted, env, nil)
+		if err != nil {
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
-	// return an error msg if user is not activated
-	if !user.Activated {
+
+	// development only, tell the client why nothing will be sent
+	outcome, err := app.sendPassResetToken(app.requestInfo(r), input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	switch outcome {
+	case outcomeUnknownEmail:
+		v.AddError("email", "no matching email address found")
+	case outcomeNotActivated:
 		v.AddError("email", "user account must be activated")
+	}
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	// if not all above, create a new password reset token with a 45-min expiry time
-	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScoprPassReset)
+
+	// send a 202 and confirmation msg to the user
+	env := envelope{"message": "an email will be sent to you containing the password reset instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
 	}
+}
+
+// look up the account for an email address and email it a password reset
+// token if it's activated, the outcome is recorded as a security event
+// and returned
+func (app *application) sendPassResetToken(info requestInfo, email string) (string, error) {
+	user, err := app.models.Users.GetByEmail(email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.recordEvent(info, data.EventPasswordResetRequested, 0, map[string]string{
+				"outcome": outcomeUnknownEmail,
+				"email":   email,
+			})
+			return outcomeUnknownEmail, nil
+		default:
+			return "", err
+		}
+	}
+	if !user.Activated {
+		app.recordEvent(info, data.EventPasswordResetRequested, user.ID, map[string]string{"outcome": outcomeNotActivated})
+		return outcomeNotActivated, nil
+	}
+
+	// create a new password reset token with a 45-min expiry time
+	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScoprPassReset)
+	if err != nil {
+		return "", err
+	}
+	app.recordEvent(info, data.EventPasswordResetRequested, user.ID, map[string]string{"outcome": outcomeSent})
+
 	// email user with their password reset token in the background
 	app.background(func() {
 		data := map[string]interface{}{
@@ -123,22 +360,18 @@ func (app *application) createPassResetHandler(w http.ResponseWriter, r *http.Re
 		// since mail address may be case sensitive, either correct user misuse
 		// or select from the db since that was take care of at the db level
 		// and we are going with selecting from db after getting thei input
-		err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+		err := app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
 		if err != nil {
 			app.logger.PrintError(err, nil)
 		}
 	})
 
-	// send a 202 and confirmation msg to the user
-	env := envelope{"message": "an email will be sent to you containing the password reset instructions"}
-
-	err = app.writeJSON(w, http.StatusAccepted, env, nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-	}
+	return outcomeSent, nil
 }
 
 // standalone activation token handler
+// like password resets, the response is the same whether or not there's
+// an account waiting to be activated
 func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	// parse and validate mail
 	var input struct {
@@ -158,32 +391,83 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	// retrieve user record that matches mail, else throw error
-	user, err := app.models.Users.GetByEmail(input.Email)
-	if err != nil {
-		switch {
-		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("email", "no matching email address found")
-			app.failedValidationResponse(w, r, v.Errors)
-		default:
+	if !app.config.auth.revealAccounts {
+		// the request is finished with by the time this runs, so take what
+		// the security event needs from it now
+		info := app.requestInfo(r)
+
+		app.background(func() {
+			_, err := app.sendActivationToken(info, input.Email)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{
+					"component": "activation",
+				})
+			}
+		})
+
+		env := envelope{"message": "if an account waiting to be activated exists for this email address, activation instructions will be sent to it"}
+
+		err = app.writeJSON(w, http.StatusAccepted, env, nil)
+		if err != nil {
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
-	// return error if user has already been activated
-	if user.Activated {
+
+	// development only, tell the client why nothing will be sent
+	outcome, err := app.sendActivationToken(app.requestInfo(r), input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	switch outcome {
+	case outcomeUnknownEmail:
+		v.AddError("email", "no matching email address found")
+	case outcomeAlreadyActivated:
 		v.AddError("email", "user has already been activated")
+	}
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	// otherwise create a new activation token
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	// send a 202
+	env := envelope{"message": "an email will be sent to you containing activation instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
+	}
+}
+
+// look up the account for an email address and email it a new activation
+// token if it isn't activated yet, the outcome is recorded as a security
+// event and returned
+func (app *application) sendActivationToken(info requestInfo, email string) (string, error) {
+	user, err := app.models.Users.GetByEmail(email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.recordEvent(info, data.EventActivationRequested, 0, map[string]string{
+				"outcome": outcomeUnknownEmail,
+				"email":   email,
+			})
+			return outcomeUnknownEmail, nil
+		default:
+			return "", err
+		}
+	}
+	if user.Activated {
+		app.recordEvent(info, data.EventActivationRequested, user.ID, map[string]string{"outcome": outcomeAlreadyActivated})
+		return outcomeAlreadyActivated, nil
 	}
 
+	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	if err != nil {
+		return "", err
+	}
+	app.recordEvent(info, data.EventActivationRequested, user.ID, map[string]string{"outcome": outcomeSent})
+
 	// email user with their additional activation token
 	app.background(func() {
 		data := map[string]interface{}{
@@ -198,10 +482,191 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		}
 	})
 
-	// send a 202
-	env := envelope{"message": "an email will be sent to you containing activation instructions"}
+	return outcomeSent, nil
+}
 
-	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+// exchange a refresh token for a new access/refresh token pair
+// every refresh token can only be used once, presenting one again revokes
+// every token descended from the same login
+func (app *application) refreshAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, refreshToken, err := app.models.Tokens.Rotate(input.RefreshToken, app.config.auth.accessTTL, app.config.auth.refreshTTL, app.config.auth.mode == "signed")
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidRefreshTokenResponse(w, r)
+		case errors.Is(err, data.ErrTokenReused):
+			// either the client or an attacker has a stale copy, either way
+			// the whole family is gone now and the user has to log in again
+			app.logger.PrintInfo("refresh token reuse detected, token family revoked", map[string]string{
+				"request_method": r.Method,
+				"request_url":    r.URL.String(),
+			})
+			var reused *data.TokenReusedError
+			if errors.As(err, &reused) {
+				// access tokens already issued to the family go too
+				err = app.revokeSignedFamily(reused.FamilyID)
+				if err != nil {
+					app.serverErrorResponse(w, r, err)
+					return
+				}
+				app.recordSecurityEvent(r, data.EventTokenReused, reused.UserID, nil)
+			}
+			app.invalidRefreshTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	token, err = app.issueAccessToken(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, errAccountSuspended):
+			app.accountSuspendedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refreshToken}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// DELETE /v1/tokens/authentication, log out
+// revokes the token the request was made with, along with the rest of
+// its session
+func (app *application) deleteAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	token := app.contextGetToken(r)
+
+	// api keys aren't sessions, they're revoked by an admin
+	if data.IsAPIKey(token) {
+		app.badRequestResponse(w, r, errors.New("api keys are revoked with DELETE /v1/admin/api-keys/:id"))
+		return
+	}
+
+	// signed tokens aren't in the tokens table, they go on the denylist
+	if app.signingKeys != nil && jwt.LooksSigned(token) {
+		err = app.revokeSignedToken(token)
+	} else {
+		err = app.models.Sessions.DeleteForToken(token)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.recordSecurityEvent(r, data.EventTokensRevoked, app.contextGetUser(r).ID, map[string]string{"reason": "logout"})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// GET /v1/users/me/sessions, list the user's active sessions
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.models.Sessions.GetAllForUser(user.ID, app.contextGetToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// DELETE /v1/users/me/sessions/:id, end a specific session
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// scoped to the user, so other users' sessions come back as a 404
+	familyID, err := app.models.Sessions.Delete(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// signed access tokens issued for the session aren't in the tokens table
+	err = app.revokeSignedFamily(familyID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.recordSecurityEvent(r, data.EventTokensRevoked, user.ID, map[string]string{
+		"reason":     "session_ended",
+		"session_id": strconv.FormatInt(id, 10),
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully ended"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// DELETE /v1/users/me/sessions, log out everywhere, including the
+// current session
+func (app *application) deleteAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		err := app.models.Tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err := app.models.Sessions.DeleteAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// signed access tokens aren't in the tokens table, this one included
+	err = app.revokeSignedTokensForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.recordSecurityEvent(r, data.EventTokensRevoked, user.ID, map[string]string{"reason": "all_sessions"})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out of all sessions"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -2,13 +2,20 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/meistens/api_practice/internal/data"
+	"github.com/meistens/api_practice/internal/jwt"
 	"github.com/meistens/api_practice/internal/validator"
 )
 
+// how recent a login has to be to stand in for the password when deleting
+// the account
+const reauthWindow = 5 * time.Minute
+
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
 	// create anonymous struct to hold expected data from request body
 	var input struct {
@@ -43,13 +50,28 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	// validate user struct and return the error msg to the client
 	// if any of the checks fail
-	if data.ValidateUser(v, user); !v.Valid() {
+	data.ValidateUser(v, user)
+
+	err = app.passwords.Validate(v, "password", input.Password, input.Name, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	// give the new user the default role, which brings their permissions
+	roleIDs, err := app.newUserRoles()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	// insert the user data into the db
-	err = app.models.Users.Insert(user)
+	err = app.models.Users.Insert(user, roleIDs...)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
@@ -61,14 +83,6 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// add "movies:read" permission to the new user
-	// switch-case maybe?
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
 	// after user record has been created in the db, generate a new
 	// activation token for the user
 	token, err := app.models.Tokens.New(user.ID, 3*12*time.Hour, data.ScopeActivation)
@@ -201,6 +215,19 @@ func (app *application) updateUserPassHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	// the new password can only be checked against the user's details
+	// once we know who they are
+	err = app.passwords.Validate(v, "password", input.Password, user.Name, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	// set the new password for the user
 	err = user.Password.Set(input.Password)
 	if err != nil {
@@ -221,13 +248,16 @@ func (app *application) updateUserPassHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	// if all works out, delete all password reset tokens for the user
-	err = app.models.Tokens.DeleteAllForUser(data.ScoprPassReset, user.ID)
+	// if all works out, delete all password reset tokens for the user, and
+	// log them out everywhere in case whoever knew the old password is
+	err = app.revokeAllTokens(user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	app.recordSecurityEvent(r, data.EventPasswordReset, user.ID, nil)
+
 	// send user a confirmation message
 	env := envelope{"message": "your password has been successfully reset"}
 
@@ -236,3 +266,559 @@ func (app *application) updateUserPassHandler(w http.ResponseWriter, r *http.Req
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// GET /v1/users/me, profile and permissions of the authenticated user
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllUserPerms(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	// the version goes out as an ETag so it can be sent back in If-Match
+	headers := make(http.Header)
+	headers.Set("ETag", versionETag(user.Version))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user, "permissions": permissions}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// PATCH /v1/users/me, only the name can be changed here
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// if the client sent an If-Match header, it must match the version of the
+	// record it last saw
+	if !app.ifMatch(r, user.Version) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Name *string `json:"name"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	v := validator.New()
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// the version check in update() catches anything that changed the record
+	// since it was loaded by the authenticate middleware
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", versionETag(user.Version))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// PUT /v1/users/me/password, change the password of a logged in user
+// unlike updateUserPassHandler this needs the current password rather
+// than a reset token
+func (app *application) changeCurrentUserPassHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+	data.ValidatePasswordPlaintext(v, input.NewPassword)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !app.confirmPassword(w, r, user, input.CurrentPassword, "current_password") {
+		return
+	}
+
+	err = app.passwords.Validate(v, "new_password", input.NewPassword, user.Name, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = user.Password.Set(input.NewPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// any outstanding reset tokens are for the old password, and sessions
+	// were opened with it, drop them all, this one included
+	err = app.revokeAllTokens(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.recordSecurityEvent(r, data.EventPasswordChanged, user.ID, nil)
+
+	env := envelope{"message": "your password has been successfully changed, please log in again"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// POST /v1/users/me/email, start an email address change
+// the new address is stored as pending and only replaces the current one
+// once confirmed with the token sent to it
+func (app *application) requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	v.Check(input.Password != "", "password", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// a bearer token alone isn't enough to move the account to another address
+	if !app.confirmPassword(w, r, user, input.Password, "password") {
+		return
+	}
+
+	// email is citext in the db, so compare the same way
+	if strings.EqualFold(input.Email, user.Email) {
+		v.AddError("email", "must be different from your current email address")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// catch the obvious duplicate early, the confirm step still handles the race
+	_, err = app.models.Users.GetByEmail(input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.SetPendingEmail(user.ID, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// only the latest request can be confirmed
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeEmailChange)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// confirmation goes to the new address, a heads-up to the old one
+	app.background(func() {
+		data := map[string]any{
+			"emailChangeToken": token.Plaintext,
+		}
+
+		err := app.mailer.Send(input.Email, "token_email_change.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+
+		data = map[string]any{
+			"newEmail": input.Email,
+		}
+
+		err = app.mailer.Send(user.Email, "email_change_notice.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	env := envelope{"message": "an email will be sent to the new address containing confirmation instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// PUT /v1/users/me/email, confirm a pending email change with the token
+// sent to the new address
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	previousEmail := user.Email
+
+	err = app.models.Users.ConfirmPendingEmail(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		// another account registered or moved to the address after the
+		// change was requested, the pending change can't go through
+		case errors.Is(err, data.ErrDuplicateEmail):
+			err = app.models.Users.ClearPendingEmail(user.ID)
+			if err == nil {
+				err = app.models.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+			}
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the token is single use, and existing sessions were opened under the
+	// old address so they're revoked too, along with any other pending
+	// action tokens sent there
+	err = app.revokeAllTokens(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.recordSecurityEvent(r, data.EventEmailChanged, user.ID, map[string]string{
+		"previous_email": previousEmail,
+		"email":          user.Email,
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// GET /v1/users/me/export, download everything held about the user as JSON
+func (app *application) exportCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllUserPerms(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	tokens, err := app.models.Tokens.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	sessions, err := app.models.Sessions.GetAllForUser(user.ID, app.contextGetToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	attempts, err := app.models.LoginAttempts.GetAllForUser(user.ID, 0)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	events, err := app.models.Events.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	movies, err := app.models.Movies.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// it's the user's own data, so ownership is always included
+	for _, movie := range movies {
+		movie.ExposeOwner()
+	}
+
+	env := envelope{
+		"exported_at":     time.Now().UTC(),
+		"user":            user,
+		"permissions":     permissions,
+		"tokens":          tokens,
+		"sessions":        sessions,
+		"login_attempts":  attempts,
+		"security_events": events,
+		"movies":          movies,
+	}
+
+	// have browsers save it as a file rather than display it
+	headers := make(http.Header)
+	headers.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="greenlight-export-%d.json"`, user.ID))
+
+	err = app.writeJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// check if the request's token comes from a login in the last reauthWindow,
+// for actions which would otherwise need the password
+// API keys and OAuth access tokens aren't sessions, so never count
+func (app *application) loggedInRecently(r *http.Request, userID int64) (bool, error) {
+	token := app.contextGetToken(r)
+
+	if data.IsAPIKey(token) {
+		return false, nil
+	}
+	if _, ok := app.contextGetOAuthGrant(r); ok {
+		return false, nil
+	}
+
+	var familyID []byte
+
+	if app.signingKeys != nil && jwt.LooksSigned(token) {
+		claims, err := app.signingKeys.Verify(token, time.Now())
+		if err != nil {
+			return false, nil
+		}
+		if familyID = claims.FamilyID(); familyID == nil {
+			return false, nil
+		}
+	}
+
+	startedAt, err := app.models.Sessions.StartedAt(userID, familyID, token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return time.Since(startedAt) <= reauthWindow, nil
+}
+
+// DELETE /v1/users/me, schedule the account for deletion
+// the account is purged by the background purger once the grace period is
+// over, logging in again before then cancels it
+// a bearer token alone can't delete the account, it takes the password, a
+// 2FA code, or a session logged into within the last few minutes, which is
+// the only way for accounts created through OpenID Connect
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	switch {
+	case input.Password != "":
+		if !app.confirmPassword(w, r, user, input.Password, "password") {
+			return
+		}
+
+	case input.Code != "" || input.RecoveryCode != "":
+		validateMFAInput(v, input.Code, input.RecoveryCode)
+		if v.Check(user.TwoFactorEnabled, "code", "two-factor authentication is not enabled"); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		ok, err := app.checkMFACode(user.ID, input.Code, input.RecoveryCode)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !ok {
+			app.invalidMFACodeResponse(w, r)
+			return
+		}
+
+	default:
+		recent, err := app.loggedInRecently(r, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !recent {
+			v.AddError("password", "must be provided, or send a 2FA code, or log in again first")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	err = app.models.Users.ScheduleDeletion(user, time.Now().Add(app.config.accounts.deletionGrace))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// log the user out everywhere and drop any pending action tokens
+	err = app.revokeAllTokens(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		data := map[string]any{
+			"deletionDate": user.DeletionScheduledAt.UTC().Format("2 January 2006 15:04 MST"),
+		}
+
+		err := app.mailer.Send(user.Email, "account_deletion.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	env := envelope{
+		"message":               "your account has been scheduled for deletion, log in again before then to cancel",
+		"deletion_scheduled_at": user.DeletionScheduledAt,
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,218 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/meistens/api_practice/internal/validator"
+)
+
+// every API key starts with this, so they're easy to tell apart from
+// bearer tokens (and to spot in leaked config)
+const APIKeyPrefix = "gl_"
+
+// an API key for a service account
+// only the hash is stored, the plaintext is returned once when the key is
+// created, prefix is the first few characters kept for telling keys apart
+type APIKey struct {
+	ID          int64       `json:"id"`
+	UserID      int64       `json:"user_id"`
+	Name        string      `json:"name"`
+	Plaintext   string      `json:"key,omitempty"`
+	Prefix      string      `json:"prefix"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	CreatedAt   time.Time   `json:"created_at"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+	Expiry      *time.Time  `json:"expiry"`
+}
+
+// check if a bearer value is an API key rather than a token
+func IsAPIKey(plaintext string) bool {
+	return strings.HasPrefix(plaintext, APIKeyPrefix)
+}
+
+func ValidateAPIKeyPlaintext(v *validator.Validator, plaintext string) {
+	v.Check(plaintext != "", "api_key", "must be provided")
+	v.Check(IsAPIKey(plaintext), "api_key", "must start with "+APIKeyPrefix)
+	v.Check(len(plaintext) == len(APIKeyPrefix)+32, "api_key", "must be 35 bytes long")
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey, known Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 200, "name", "must not be more than 200 bytes long")
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range key.Permissions {
+		v.Check(known.Defines(code), "permissions", "unknown permission code "+code)
+	}
+}
+
+// define APIKeyModel type
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// generate a new key for a service account and insert it, the returned key
+// holds the plaintext
+// a ttl of 0 means the key doesn't expire
+func (m APIKeyModel) New(key *APIKey, ttl time.Duration) error {
+	// 20 random bytes encode to exactly 32 base32 characters
+	randomBytes := make([]byte, 20)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	key.Plaintext = APIKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	key.Prefix = key.Plaintext[:len(APIKeyPrefix)+6]
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	if ttl > 0 {
+		expiry := time.Now().Add(ttl)
+		key.Expiry = &expiry
+	}
+
+	query := `INSERT INTO api_keys (user_id, name, prefix, hash, permissions, expiry)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at`
+
+	args := []any{key.UserID, key.Name, key.Prefix, key.Hash, pq.Array([]string(key.Permissions)), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// list the keys of a service account, without plaintexts
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `SELECT id, user_id, name, prefix, permissions, created_at, last_used_at, expiry
+	FROM api_keys
+	WHERE user_id = $1
+	ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var (
+			key   APIKey
+			codes []string
+		)
+
+		err := rows.Scan(
+			&key.ID,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			pq.Array(&codes),
+			&key.CreatedAt,
+			&key.LastUsedAt,
+			&key.Expiry,
+		)
+		if err != nil {
+			return nil, err
+		}
+		key.Permissions = Permissions(codes)
+
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// revoke a key
+func (m APIKeyModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM api_keys
+	WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// look up an unexpired key, returning the service account it belongs to
+// and the permissions it carries
+// the key's last_used_at is bumped in the same statement
+func (m APIKeyModel) GetForKey(plaintext string) (*User, Permissions, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `WITH key AS (
+		UPDATE api_keys SET last_used_at = NOW()
+		WHERE hash = $1 AND (expiry IS NULL OR expiry > NOW())
+		RETURNING user_id, permissions
+	)
+	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version, users.deletion_scheduled_at, users.service_account, users.totp_enabled, users.suspended_at, key.permissions
+	FROM users
+	INNER JOIN key ON users.id = key.user_id`
+
+	var (
+		user  User
+		codes []string
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.DeletionScheduledAt,
+		&user.ServiceAccount,
+		&user.TwoFactorEnabled,
+		&user.SuspendedAt,
+		pq.Array(&codes),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	return &user, Permissions(codes), nil
+}
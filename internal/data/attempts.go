@@ -0,0 +1,239 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// outcomes recorded for a login attempt
+const (
+	LoginSuccess            = "success"
+	LoginInvalidCredentials = "invalid_credentials"
+	LoginLocked             = "locked"
+	LoginThrottled          = "throttled"
+)
+
+// a single login attempt, kept for auditing
+type LoginAttempt struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id,omitempty"`
+	Email     string    `json:"email"`
+	IP        string    `json:"ip"`
+	Outcome   string    `json:"outcome"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// failed logins since the last successful one, and when the account can
+// be tried again
+type Lockout struct {
+	Failures    int
+	LockedUntil *time.Time
+}
+
+// check if the account can't be logged into at the moment
+func (l *Lockout) Active(now time.Time) bool {
+	return l.LockedUntil != nil && l.LockedUntil.After(now)
+}
+
+// define LoginAttemptModel type
+type LoginAttemptModel struct {
+	DB *sql.DB
+}
+
+// record an attempt, userID is 0 when the email didn't match an account
+func (m LoginAttemptModel) Insert(attempt *LoginAttempt) error {
+	query := `INSERT INTO login_attempts (user_id, email, ip, outcome)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id, created_at`
+
+	args := []any{nullInt64(attempt.UserID), attempt.Email, attempt.IP, attempt.Outcome}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&attempt.ID, &attempt.CreatedAt)
+}
+
+// number of failed attempts from an IP since a point in time, and when the
+// latest of them was
+func (m LoginAttemptModel) IPFailures(ip string, since time.Time) (int, time.Time, error) {
+	query := `SELECT count(*), COALESCE(max(created_at), 'epoch')
+	FROM login_attempts
+	WHERE ip = $1 AND outcome = $2 AND created_at > $3`
+
+	var (
+		count  int
+		latest time.Time
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, ip, LoginInvalidCredentials, since).Scan(&count, &latest)
+	return count, latest, err
+}
+
+// the latest attempts for a user, newest first, a limit of 0 returns them
+// all
+// attempts with the user's email address from before the account existed
+// are included too
+func (m LoginAttemptModel) GetAllForUser(userID int64, limit int) ([]*LoginAttempt, error) {
+	query := `SELECT id, COALESCE(user_id, 0), email, ip, outcome, created_at
+	FROM login_attempts
+	WHERE user_id = $1
+	OR (user_id IS NULL AND email = (SELECT email FROM users WHERE id = $1))
+	ORDER BY created_at DESC, id DESC
+	LIMIT NULLIF($2, 0)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []*LoginAttempt{}
+
+	for rows.Next() {
+		var attempt LoginAttempt
+
+		err := rows.Scan(
+			&attempt.ID,
+			&attempt.UserID,
+			&attempt.Email,
+			&attempt.IP,
+			&attempt.Outcome,
+			&attempt.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, &attempt)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// retrieve a user's lockout state, a user with no failures gets an empty one
+func (m LoginAttemptModel) GetLockout(userID int64) (*Lockout, error) {
+	query := `SELECT failures, locked_until
+	FROM login_lockouts
+	WHERE user_id = $1`
+
+	var lockout Lockout
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&lockout.Failures, &lockout.LockedUntil)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return &Lockout{}, nil
+		default:
+			return nil, err
+		}
+	}
+	return &lockout, nil
+}
+
+// count a failed login against a user and set when they can next try,
+// lockedUntil is worked out from the new failure count
+func (m LoginAttemptModel) RecordFailure(userID int64, lockedUntil func(failures int) *time.Time) (*Lockout, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	// the upsert locks the row, so concurrent failures are all counted
+	query := `INSERT INTO login_lockouts (user_id, failures)
+	VALUES ($1, 1)
+	ON CONFLICT (user_id) DO UPDATE
+	SET failures = login_lockouts.failures + 1
+	RETURNING failures`
+
+	var lockout Lockout
+
+	err = tx.QueryRowContext(ctx, query, userID).Scan(&lockout.Failures)
+	if err != nil {
+		return nil, err
+	}
+
+	lockout.LockedUntil = lockedUntil(lockout.Failures)
+
+	_, err = tx.ExecContext(ctx, `UPDATE login_lockouts SET locked_until = $1 WHERE user_id = $2`, lockout.LockedUntil, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &lockout, nil
+}
+
+// go through the same transaction as RecordFailure without changing
+// anything, for logins with an unknown email address which shouldn't be
+// told apart from a wrong password by how long they take
+func (m LoginAttemptModel) SimulateFailure() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// there's never a lockout for user 0, so both statements match nothing
+	var failures int
+
+	err = tx.QueryRowContext(ctx, `SELECT failures FROM login_lockouts WHERE user_id = 0 FOR UPDATE`).Scan(&failures)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE login_lockouts SET locked_until = NULL WHERE user_id = 0`)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// clear a user's failures and any lockout, after a successful login or
+// when the account is unlocked
+// returns ErrRecordNotFound if there was nothing to clear
+func (m LoginAttemptModel) ClearLockout(userID int64) error {
+	query := `DELETE FROM login_lockouts
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
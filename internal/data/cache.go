@@ -0,0 +1,293 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the postgres channel cache invalidations are sent on, every instance
+// listens on it and drops the same entries
+const AuthCacheChannel = "auth_cache"
+
+// notification payloads besides a user ID, dropping every user's
+// permissions (a role changed) or everything
+const (
+	authCacheAllPermissions = "permissions"
+	authCacheAll            = "*"
+)
+
+// in-process cache for the two lookups every authenticated request makes,
+// authentication token to user and user to permissions
+// entries live for a short TTL, and are dropped as soon as the models
+// change anything they depend on, here and on other instances through
+// NOTIFY, so the TTL only matters if a notification is lost
+// a nil *AuthCache caches nothing
+type AuthCache struct {
+	DB         *sql.DB
+	ttl        time.Duration
+	maxEntries int
+
+	mu          sync.Mutex
+	users       map[[32]byte]userCacheEntry
+	permissions map[int64]permissionsCacheEntry
+	// bumped by every invalidation, so a lookup which raced with one
+	// doesn't cache what it read
+	generation uint64
+
+	userHits         atomic.Int64
+	userMisses       atomic.Int64
+	permissionHits   atomic.Int64
+	permissionMisses atomic.Int64
+	notifyErrors     atomic.Int64
+}
+
+type userCacheEntry struct {
+	user    User
+	expires time.Time
+}
+
+type permissionsCacheEntry struct {
+	permissions Permissions
+	expires     time.Time
+}
+
+// counters for expvar
+type AuthCacheStats struct {
+	UserHits         int64 `json:"user_hits"`
+	UserMisses       int64 `json:"user_misses"`
+	PermissionHits   int64 `json:"permission_hits"`
+	PermissionMisses int64 `json:"permission_misses"`
+	NotifyErrors     int64 `json:"notify_errors"`
+	Users            int   `json:"users"`
+	Permissions      int   `json:"permissions"`
+}
+
+// returns nil, so nothing is cached, if ttl or maxEntries isn't positive
+// maxEntries bounds the users and permissions maps separately
+func NewAuthCache(db *sql.DB, ttl time.Duration, maxEntries int) *AuthCache {
+	if ttl <= 0 || maxEntries <= 0 {
+		return nil
+	}
+	return &AuthCache{
+		DB:          db,
+		ttl:         ttl,
+		maxEntries:  maxEntries,
+		users:       make(map[[32]byte]userCacheEntry),
+		permissions: make(map[int64]permissionsCacheEntry),
+	}
+}
+
+// the current generation, to pass to setUser() or setPermissions() after
+// reading from the database
+func (c *AuthCache) currentGeneration() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generation
+}
+
+// the user an authentication token hash belongs to, a copy so the caller
+// can change it
+func (c *AuthCache) getUser(tokenHash [32]byte) (*User, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.users[tokenHash]
+	if !found || time.Now().After(entry.expires) {
+		c.userMisses.Add(1)
+		return nil, false
+	}
+	c.userHits.Add(1)
+
+	user := entry.user
+	return &user, true
+}
+
+// cache the user for a token, for no longer than the token lasts
+// generation is from before the user was read
+func (c *AuthCache) setUser(tokenHash [32]byte, user *User, tokenExpiry time.Time, generation uint64) {
+	if c == nil {
+		return
+	}
+
+	expires := time.Now().Add(c.ttl)
+	if tokenExpiry.Before(expires) {
+		expires = tokenExpiry
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if len(c.users) >= c.maxEntries {
+		now := time.Now()
+		for k, entry := range c.users {
+			if now.After(entry.expires) {
+				delete(c.users, k)
+			}
+		}
+		// still full, start over rather than track usage order
+		if len(c.users) >= c.maxEntries {
+			c.users = make(map[[32]byte]userCacheEntry)
+		}
+	}
+
+	c.users[tokenHash] = userCacheEntry{user: *user, expires: expires}
+}
+
+// a user's permissions, a copy so the caller can append to it
+func (c *AuthCache) getPermissions(userID int64) (Permissions, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.permissions[userID]
+	if !found || time.Now().After(entry.expires) {
+		c.permissionMisses.Add(1)
+		return nil, false
+	}
+	c.permissionHits.Add(1)
+
+	if entry.permissions == nil {
+		return nil, true
+	}
+	return append(Permissions{}, entry.permissions...), true
+}
+
+// generation is from before the permissions were read
+func (c *AuthCache) setPermissions(userID int64, permissions Permissions, generation uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if len(c.permissions) >= c.maxEntries {
+		now := time.Now()
+		for k, entry := range c.permissions {
+			if now.After(entry.expires) {
+				delete(c.permissions, k)
+			}
+		}
+		if len(c.permissions) >= c.maxEntries {
+			c.permissions = make(map[int64]permissionsCacheEntry)
+		}
+	}
+
+	var stored Permissions
+	if permissions != nil {
+		stored = append(Permissions{}, permissions...)
+	}
+	c.permissions[userID] = permissionsCacheEntry{permissions: stored, expires: time.Now().Add(c.ttl)}
+}
+
+// drop everything cached for the users, here and on every other instance
+func (c *AuthCache) invalidateUsers(userIDs ...int64) {
+	for _, id := range userIDs {
+		c.invalidate(strconv.FormatInt(id, 10))
+	}
+}
+
+// drop every user's permissions, for changes to roles which any number of
+// users could hold
+func (c *AuthCache) invalidateAllPermissions() {
+	c.invalidate(authCacheAllPermissions)
+}
+
+func (c *AuthCache) invalidate(payload string) {
+	if c == nil {
+		return
+	}
+
+	c.Forget(payload)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// the change has already been made, so failing to tell the other
+	// instances isn't an error for the caller, their entries expire anyway
+	_, err := c.DB.ExecContext(ctx, `SELECT pg_notify($1, $2)`, AuthCacheChannel, payload)
+	if err != nil {
+		c.notifyErrors.Add(1)
+	}
+}
+
+// drop the entries a notification payload names, for notifications from
+// other instances
+func (c *AuthCache) Forget(payload string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+
+	switch payload {
+	case authCacheAll:
+		c.users = make(map[[32]byte]userCacheEntry)
+		c.permissions = make(map[int64]permissionsCacheEntry)
+	case authCacheAllPermissions:
+		c.permissions = make(map[int64]permissionsCacheEntry)
+	default:
+		userID, err := strconv.ParseInt(payload, 10, 64)
+		if err != nil {
+			return
+		}
+		delete(c.permissions, userID)
+		for k, entry := range c.users {
+			if entry.user.ID == userID {
+				delete(c.users, k)
+			}
+		}
+	}
+}
+
+// drop everything, for when notifications may have been missed
+func (c *AuthCache) Flush() {
+	c.Forget(authCacheAll)
+}
+
+func (c *AuthCache) Stats() AuthCacheStats {
+	if c == nil {
+		return AuthCacheStats{}
+	}
+
+	c.mu.Lock()
+	users, permissions := len(c.users), len(c.permissions)
+	c.mu.Unlock()
+
+	return AuthCacheStats{
+		UserHits:         c.userHits.Load(),
+		UserMisses:       c.userMisses.Load(),
+		PermissionHits:   c.permissionHits.Load(),
+		PermissionMisses: c.permissionMisses.Load(),
+		NotifyErrors:     c.notifyErrors.Load(),
+		Users:            users,
+		Permissions:      permissions,
+	}
+}
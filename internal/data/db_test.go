@@ -0,0 +1,67 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// tests which need PostgreSQL run against the database in this variable,
+// with every migration applied, and are skipped when it isn't set
+// they add and delete rows of their own, but the reaper and purger tests
+// also clear out whatever else is due, so don't point it at a database
+// you care about
+const testDSNEnv = "GREENLIGHT_TEST_DB_DSN"
+
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s not set", testDSNEnv)
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// insert a user with an address no other test run uses, deleted again when
+// the test ends if it's still there
+func newTestUser(t *testing.T, models Models) *User {
+	t.Helper()
+
+	user := &User{
+		Name:  "Test User",
+		Email: fmt.Sprintf("test-%d@example.com", time.Now().UnixNano()),
+	}
+
+	err := user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = models.Users.Insert(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		models.db.Exec(`DELETE FROM login_attempts WHERE email = $1`, user.Email)
+		models.db.Exec(`DELETE FROM users WHERE id = $1`, user.ID)
+	})
+	return user
+}
@@ -0,0 +1,160 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// the postgres channel denylist changes are announced on, so every
+// instance reloads its copy straight away
+const DenylistChannel = "token_denylist"
+
+// define DenylistModel type, for signed access tokens revoked before
+// they expire
+type DenylistModel struct {
+	DB *sql.DB
+}
+
+// add a token ID to the denylist, it only needs to stay there until the
+// token would have expired anyway
+func (m DenylistModel) Insert(jti string, expiry time.Time) error {
+	query := `INSERT INTO token_denylist (jti, expiry)
+	VALUES ($1, $2)
+	ON CONFLICT (jti) DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, jti, expiry)
+	if err != nil {
+		return err
+	}
+
+	m.notify(ctx)
+	return nil
+}
+
+// revoke every signed token issued to a user so far, or to every user for
+// userID 0, and return the time they were revoked at
+func (m DenylistModel) RevokeUser(userID int64) (time.Time, error) {
+	query := `INSERT INTO token_denylist_users (user_id)
+	VALUES ($1)
+	ON CONFLICT (user_id) DO UPDATE SET revoked_at = GREATEST(token_denylist_users.revoked_at, EXCLUDED.revoked_at)
+	RETURNING revoked_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var revokedAt time.Time
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&revokedAt)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	m.notify(ctx)
+	return revokedAt, nil
+}
+
+// the other instances only miss out until their next periodic reload if
+// this fails, so it isn't an error for the caller
+func (m DenylistModel) notify(ctx context.Context) {
+	m.DB.ExecContext(ctx, `SELECT pg_notify($1, '')`, DenylistChannel)
+}
+
+// delete up to limit entries for tokens which have expired, returning how
+// many were deleted
+// GetAllActive() already leaves them out, so nobody needs to hear about it
+func (m DenylistModel) DeleteExpired(limit int) (int64, error) {
+	query := `DELETE FROM token_denylist
+	WHERE jti IN (
+		SELECT jti FROM token_denylist
+		WHERE expiry < NOW()
+		LIMIT $1
+	)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// return the unexpired denylist entries, keyed by token ID
+func (m DenylistModel) GetAllActive() (map[string]time.Time, error) {
+	query := `SELECT jti, expiry
+	FROM token_denylist
+	WHERE expiry > NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make(map[string]time.Time)
+
+	for rows.Next() {
+		var (
+			jti    string
+			expiry time.Time
+		)
+
+		err := rows.Scan(&jti, &expiry)
+		if err != nil {
+			return nil, err
+		}
+
+		entries[jti] = expiry
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// return the users whose signed tokens were revoked after since, keyed by
+// user ID, older revocations only cover tokens which have expired anyway
+func (m DenylistModel) GetRevokedUsers(since time.Time) (map[int64]time.Time, error) {
+	query := `SELECT user_id, revoked_at
+	FROM token_denylist_users
+	WHERE revoked_at > $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[int64]time.Time)
+
+	for rows.Next() {
+		var (
+			userID    int64
+			revokedAt time.Time
+		)
+
+		err := rows.Scan(&userID, &revokedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		users[userID] = revokedAt
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
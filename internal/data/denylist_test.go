@@ -0,0 +1,63 @@
+package data
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDenylistDeleteExpired(t *testing.T) {
+	db := newTestDB(t)
+	models := NewModels(db, nil)
+
+	prefix := fmt.Sprintf("test-%d-", time.Now().UnixNano())
+	t.Cleanup(func() { db.Exec(`DELETE FROM token_denylist WHERE jti LIKE $1`, prefix+"%") })
+
+	for i := range 5 {
+		err := models.Denylist.Insert(fmt.Sprintf("%sexpired-%d", prefix, i), time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	live := prefix + "live"
+	err := models.Denylist.Insert(live, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// batches never go over the limit, and the last one comes up short
+	const limit = 2
+	for {
+		n, err := models.Denylist.DeleteExpired(limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > limit {
+			t.Fatalf("deleted %d entries, limit %d", n, limit)
+		}
+		if n < limit {
+			break
+		}
+	}
+
+	var left []string
+	rows, err := db.Query(`SELECT jti FROM token_denylist WHERE jti LIKE $1`, prefix+"%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jti string
+		if err := rows.Scan(&jti); err != nil {
+			t.Fatal(err)
+		}
+		left = append(left, jti)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(left) != 1 || left[0] != live {
+		t.Errorf("entries left %v, want [%s]", left, live)
+	}
+}
@@ -0,0 +1,256 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/meistens/api_practice/internal/validator"
+)
+
+// types of security event
+const (
+	EventLogin                  = "login"
+	EventLoginFailed            = "login_failed"
+	EventAccountLocked          = "account_locked"
+	EventAccountUnlocked        = "account_unlocked"
+	EventPasswordResetRequested = "password_reset_requested"
+	EventActivationRequested    = "activation_requested"
+	EventPasswordReset          = "password_reset"
+	EventPasswordChanged        = "password_changed"
+	EventPasswordResetForced    = "password_reset_forced"
+	EventEmailChanged           = "email_changed"
+	EventMFAEnabled             = "mfa_enabled"
+	EventMFADisabled            = "mfa_disabled"
+	EventTokensRevoked          = "tokens_revoked"
+	EventTokenReused            = "token_reused"
+	EventPermissionGranted      = "permission_granted"
+	EventPermissionRevoked      = "permission_revoked"
+	EventRoleAssigned           = "role_assigned"
+	EventRoleUnassigned         = "role_unassigned"
+	EventAccountActivated       = "account_activated"
+	EventAccountDeactivated     = "account_deactivated"
+	EventAccountSuspended       = "account_suspended"
+	EventAccountUnsuspended     = "account_unsuspended"
+)
+
+// every event type, for validating filters
+var EventTypes = []string{
+	EventLogin, EventLoginFailed, EventAccountLocked, EventAccountUnlocked,
+	EventPasswordResetRequested, EventActivationRequested, EventPasswordReset, EventPasswordChanged, EventPasswordResetForced,
+	EventEmailChanged, EventMFAEnabled, EventMFADisabled, EventTokensRevoked, EventTokenReused,
+	EventPermissionGranted, EventPermissionRevoked, EventRoleAssigned, EventRoleUnassigned,
+	EventAccountActivated, EventAccountDeactivated, EventAccountSuspended, EventAccountUnsuspended,
+}
+
+// something which happened to a user's account, ActorID is who did it and
+// UserID whose account it was, either is 0 if there wasn't one
+type SecurityEvent struct {
+	ID        int64             `json:"id"`
+	Type      string            `json:"type"`
+	ActorID   int64             `json:"actor_id,omitempty"`
+	UserID    int64             `json:"user_id,omitempty"`
+	IP        string            `json:"ip"`
+	UserAgent string            `json:"user_agent"`
+	Metadata  map[string]string `json:"metadata"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// leave out who caused an event on someone else's account, along with
+// their IP and user agent, before showing it to the account's owner
+func (e *SecurityEvent) hideActor() {
+	if e.ActorID != 0 && e.ActorID != e.UserID {
+		e.ActorID = 0
+		e.IP = ""
+		e.UserAgent = ""
+	}
+}
+
+// what to list, zero values match everything
+type SecurityEventFilter struct {
+	UserID  int64
+	ActorID int64
+	Types   []string
+	IP      string
+	Since   *time.Time
+	Until   *time.Time
+	// for the account owner's own listing, events someone else caused are
+	// returned without the actor, IP and user agent, and IP doesn't match
+	// them
+	HideActors bool
+}
+
+func ValidateSecurityEventFilter(v *validator.Validator, f SecurityEventFilter) {
+	for _, t := range f.Types {
+		if !validator.In(t, EventTypes...) {
+			v.AddError("type", "unknown event type: "+t)
+			break
+		}
+	}
+	if f.Since != nil && f.Until != nil {
+		v.Check(!f.Until.Before(*f.Since), "until", "must not be before since")
+	}
+}
+
+// define SecurityEventModel type
+type SecurityEventModel struct {
+	DB *sql.DB
+}
+
+// record an event, the user agent is cut short so clients can't fill the
+// table with it
+func (m SecurityEventModel) Insert(event *SecurityEvent) error {
+	if len(event.UserAgent) > sessionUserAgentMaxLen {
+		event.UserAgent = event.UserAgent[:sessionUserAgentMaxLen]
+	}
+	if event.Metadata == nil {
+		event.Metadata = map[string]string{}
+	}
+
+	metadata, err := json.Marshal(event.Metadata)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO security_events (type, actor_id, user_id, ip, user_agent, metadata)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at`
+
+	args := []any{event.Type, nullInt64(event.ActorID), nullInt64(event.UserID), event.IP, event.UserAgent, string(metadata)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
+
+// list events matching the filter, a page at a time
+func (m SecurityEventModel) GetAll(f SecurityEventFilter, filters Filters) ([]*SecurityEvent, Metadata, error) {
+	query := fmt.Sprintf(`SELECT count(*) OVER(), id, type, COALESCE(actor_id, 0), COALESCE(user_id, 0), ip, user_agent, metadata, created_at
+	FROM security_events
+	WHERE (user_id = $1 OR $1 = 0)
+	AND (actor_id = $2 OR $2 = 0)
+	AND (type = ANY($3) OR cardinality($3) = 0)
+	AND (ip = $4 OR $4 = '')
+	AND ($4 = '' OR NOT $9 OR actor_id IS NULL OR actor_id = user_id)
+	AND (created_at >= $5 OR $5 IS NULL)
+	AND (created_at < $6 OR $6 IS NULL)
+	ORDER BY %s %s, id %s
+	LIMIT $7 OFFSET $8`, filters.sortColumn(), filters.sortDirection(), filters.sortDirection())
+
+	types := f.Types
+	if types == nil {
+		types = []string{}
+	}
+
+	args := []any{f.UserID, f.ActorID, pq.Array(types), f.IP, f.Since, f.Until, filters.limit(), filters.offset(), f.HideActors}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	events := []*SecurityEvent{}
+
+	for rows.Next() {
+		var (
+			event    SecurityEvent
+			metadata []byte
+		)
+
+		err := rows.Scan(
+			&totalRecords,
+			&event.ID,
+			&event.Type,
+			&event.ActorID,
+			&event.UserID,
+			&event.IP,
+			&event.UserAgent,
+			&metadata,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		err = json.Unmarshal(metadata, &event.Metadata)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		if f.HideActors {
+			event.hideActor()
+		}
+		events = append(events, &event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return events, metadata, nil
+}
+
+// every event about a user's account or done by them, newest first, for
+// exporting their data, events on their account which someone else caused
+// are returned as with SecurityEventFilter.HideActors
+func (m SecurityEventModel) GetAllForUser(userID int64) ([]*SecurityEvent, error) {
+	query := `SELECT id, type, COALESCE(actor_id, 0), COALESCE(user_id, 0), ip, user_agent, metadata, created_at
+	FROM security_events
+	WHERE user_id = $1 OR actor_id = $1
+	ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*SecurityEvent{}
+
+	for rows.Next() {
+		var (
+			event    SecurityEvent
+			metadata []byte
+		)
+
+		err := rows.Scan(
+			&event.ID,
+			&event.Type,
+			&event.ActorID,
+			&event.UserID,
+			&event.IP,
+			&event.UserAgent,
+			&metadata,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(metadata, &event.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		if event.UserID == userID {
+			event.hideActor()
+		}
+		events = append(events, &event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,166 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/meistens/api_practice/internal/validator"
+)
+
+// struct holding a stored idempotency key and, once the original request
+// has finished, the response that was sent for it
+// StatusCode is 0 while the original request is still in flight
+type IdempotencyRecord struct {
+	Key         string
+	UserID      int64
+	RequestHash []byte
+	StatusCode  int
+	Header      http.Header
+	Body        []byte
+	Expiry      time.Time
+}
+
+// check if the original request is still being processed
+func (r *IdempotencyRecord) InFlight() bool {
+	return r.StatusCode == 0
+}
+
+func ValidateIdempotencyKey(v *validator.Validator, key string) {
+	v.Check(key != "", "idempotency_key", "must be provided")
+	v.Check(len(key) <= 255, "idempotency_key", "must not be more than 255 bytes long")
+}
+
+// define IdempotencyModel type
+type IdempotencyModel struct {
+	DB *sql.DB
+}
+
+// reserve() claims a key for a user by inserting an in-flight record
+// an expired record with the same key is taken over
+// returns false if a live record already exists, in which case the caller
+// should Get() it and decide whether to replay or reject
+func (m IdempotencyModel) Reserve(key string, userID int64, requestHash []byte, lockTTL time.Duration) (bool, error) {
+	query := `INSERT INTO idempotency_keys (key, user_id, request_hash, expiry)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (key, user_id) DO UPDATE
+	SET request_hash = EXCLUDED.request_hash, status_code = NULL, headers = NULL, body = NULL,
+		created_at = NOW(), expiry = EXCLUDED.expiry
+	WHERE idempotency_keys.expiry <= NOW()
+	RETURNING key`
+
+	args := []any{key, userID, requestHash, time.Now().Add(lockTTL)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var returned string
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&returned)
+	if err != nil {
+		switch {
+		// nothing inserted or updated, the key is held by a live record
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// retrieve a live record for the key and user
+func (m IdempotencyModel) Get(key string, userID int64) (*IdempotencyRecord, error) {
+	query := `SELECT key, user_id, request_hash, COALESCE(status_code, 0), headers, body, expiry
+	FROM idempotency_keys
+	WHERE key = $1 AND user_id = $2 AND expiry > NOW()`
+
+	var (
+		record  IdempotencyRecord
+		headers []byte
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, key, userID).Scan(
+		&record.Key,
+		&record.UserID,
+		&record.RequestHash,
+		&record.StatusCode,
+		&headers,
+		&record.Body,
+		&record.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if headers != nil {
+		err = json.Unmarshal(headers, &record.Header)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &record, nil
+}
+
+// store the captured response against a reserved key and extend its
+// expiry to the full ttl
+func (m IdempotencyModel) Complete(key string, userID int64, statusCode int, header http.Header, body []byte, ttl time.Duration) error {
+	headers, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE idempotency_keys
+	SET status_code = $1, headers = $2, body = $3, expiry = $4
+	WHERE key = $5 AND user_id = $6`
+
+	args := []any{statusCode, headers, body, time.Now().Add(ttl), key, userID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// release a reserved key so that the request can be retried
+func (m IdempotencyModel) Delete(key string, userID int64) error {
+	query := `DELETE FROM idempotency_keys
+	WHERE key = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key, userID)
+	return err
+}
+
+// delete up to limit expired records, returning how many were deleted
+// Reserve() takes an expired key over anyway, this just stops them piling up
+func (m IdempotencyModel) DeleteExpired(limit int) (int64, error) {
+	query := `DELETE FROM idempotency_keys
+	WHERE (key, user_id) IN (
+		SELECT key, user_id FROM idempotency_keys
+		WHERE expiry < NOW()
+		LIMIT $1
+	)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,66 @@
+package data
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyDeleteExpired(t *testing.T) {
+	db := newTestDB(t)
+	models := NewModels(db, nil)
+	user := newTestUser(t, models)
+
+	reserve := func(key string, ttl time.Duration) {
+		t.Helper()
+
+		ok, err := models.Idempotency.Reserve(key, user.ID, []byte("hash"), ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("key %s already reserved", key)
+		}
+	}
+
+	for i := range 5 {
+		reserve(fmt.Sprintf("expired-%d", i), -time.Hour)
+	}
+	reserve("live", time.Hour)
+
+	// batches never go over the limit, and the last one comes up short
+	const limit = 2
+	for {
+		n, err := models.Idempotency.DeleteExpired(limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > limit {
+			t.Fatalf("deleted %d keys, limit %d", n, limit)
+		}
+		if n < limit {
+			break
+		}
+	}
+
+	var keys []string
+	rows, err := db.Query(`SELECT key FROM idempotency_keys WHERE user_id = $1`, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 1 || keys[0] != "live" {
+		t.Errorf("keys left %v, want [live]", keys)
+	}
+}
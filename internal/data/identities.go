@@ -0,0 +1,137 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+// a login started with an external OpenID Connect provider
+// only the state's hash is stored, the nonce and PKCE verifier are needed
+// in plaintext to finish the login
+type OIDCLogin struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	Expiry       time.Time
+}
+
+// 32 random bytes, base64url encoded, which also makes a valid PKCE verifier
+func randomString() (string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// define IdentityModel type
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// start a login, generating its state, nonce and PKCE verifier
+func (m IdentityModel) NewLogin(ttl time.Duration) (*OIDCLogin, error) {
+	login := &OIDCLogin{Expiry: time.Now().Add(ttl)}
+
+	var err error
+	for _, field := range []*string{&login.State, &login.Nonce, &login.CodeVerifier} {
+		*field, err = randomString()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hash := sha256.Sum256([]byte(login.State))
+
+	query := `INSERT INTO oidc_logins (state_hash, nonce, code_verifier, expiry)
+	VALUES ($1, $2, $3, $4)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, hash[:], login.Nonce, login.CodeVerifier, login.Expiry)
+	if err != nil {
+		return nil, err
+	}
+	return login, nil
+}
+
+// look up an unexpired login by its state and delete it in the same
+// statement, so a callback can only be used once
+func (m IdentityModel) ConsumeLogin(state string) (*OIDCLogin, error) {
+	hash := sha256.Sum256([]byte(state))
+
+	query := `DELETE FROM oidc_logins
+	WHERE state_hash = $1 AND expiry > NOW()
+	RETURNING nonce, code_verifier, expiry`
+
+	login := OIDCLogin{State: state}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(&login.Nonce, &login.CodeVerifier, &login.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &login, nil
+}
+
+// retrieve the user linked to an account at a provider
+func (m IdentityModel) GetUser(issuer, subject string) (*User, error) {
+	query := `SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version, users.deletion_scheduled_at, users.service_account, users.totp_enabled, users.suspended_at
+	FROM users
+	INNER JOIN user_identities ON users.id = user_identities.user_id
+	WHERE user_identities.issuer = $1 AND user_identities.subject = $2`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, issuer, subject).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.DeletionScheduledAt,
+		&user.ServiceAccount,
+		&user.TwoFactorEnabled,
+		&user.SuspendedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// link an account at a provider to a user
+func (m IdentityModel) Link(userID int64, issuer, subject string) error {
+	query := `INSERT INTO user_identities (issuer, subject, user_id)
+	VALUES ($1, $2, $3)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, issuer, subject, userID)
+	return err
+}
@@ -1,8 +1,11 @@
 package data
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
+	"time"
 )
 
 // custom errRecordnotfound error will return from the Get() method
@@ -13,21 +16,98 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// DBTX is satisfied by both *sql.DB and *sql.Tx, so a model holding one
+// can run its queries either on the pool or inside a transaction
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 // Models struct wraps the xModels
 type Models struct {
-	Movies      MovieModel
-	Permissions PermissionModel
-	Users       UserModel
-	Tokens      TokenModel
+	db            *sql.DB
+	Movies        MovieModel
+	Permissions   PermissionModel
+	Users         UserModel
+	Tokens        TokenModel
+	Stats         StatsModel
+	Idempotency   IdempotencyModel
+	Sessions      SessionModel
+	Denylist      DenylistModel
+	APIKeys       APIKeyModel
+	TOTP          TOTPModel
+	OAuth         OAuthModel
+	Identities    IdentityModel
+	LoginAttempts LoginAttemptModel
+	Roles         RoleModel
+	Events        SecurityEventModel
 }
 
 // Adding New() which returns a Models struct containing the
 // initalized instances
-func NewModels(db *sql.DB) Models {
+// the models which change users, tokens or permissions invalidate cache,
+// which can be nil
+func NewModels(db *sql.DB, cache *AuthCache) Models {
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Permissions: PermissionModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
+		db:            db,
+		Movies:        MovieModel{DB: db},
+		Permissions:   PermissionModel{DB: db, Cache: cache},
+		Users:         UserModel{DB: db, Cache: cache},
+		Tokens:        TokenModel{DB: db, Cache: cache},
+		Stats:         StatsModel{DB: db},
+		Idempotency:   IdempotencyModel{DB: db},
+		Sessions:      SessionModel{DB: db, Cache: cache},
+		Denylist:      DenylistModel{DB: db},
+		APIKeys:       APIKeyModel{DB: db},
+		TOTP:          TOTPModel{DB: db, Cache: cache},
+		OAuth:         OAuthModel{DB: db, Cache: cache},
+		Identities:    IdentityModel{DB: db},
+		LoginAttempts: LoginAttemptModel{DB: db},
+		Roles:         RoleModel{DB: db, Cache: cache},
+		Events:        SecurityEventModel{DB: db},
+	}
+}
+
+// start a transaction on the conn. pool, models can be bound to it
+// using their WithTx() method
+func (m Models) BeginTx(ctx context.Context) (*sql.Tx, error) {
+	return m.db.BeginTx(ctx, nil)
+}
+
+// run fn while holding the postgres advisory lock key, so only one instance
+// runs it at a time, returns false without running fn if another instance
+// holds the lock
+func (m Models) WithAdvisoryLock(ctx context.Context, key int64, fn func() error) (bool, error) {
+	// session level locks belong to a connection, so hold on to one
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return false, err
 	}
+	defer conn.Close()
+
+	var acquired bool
+
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&acquired)
+	if err != nil {
+		return false, err
+	}
+	if !acquired {
+		return false, nil
+	}
+
+	defer func() {
+		// not ctx, which may have been cancelled by now
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+
+		_, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, key)
+		if err != nil {
+			// throw the connection away rather than put it back in the
+			// pool still holding the lock
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+	}()
+
+	return true, fn()
 }
@@ -0,0 +1,103 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// only used by this test, so it can't collide with the token reaper's lock
+const testLockID = 480049
+
+func TestWithAdvisoryLock(t *testing.T) {
+	db := newTestDB(t)
+	models := NewModels(db, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// another instance, holding the lock on a connection of its own
+	other, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	tryLock := func(t *testing.T) bool {
+		t.Helper()
+
+		var acquired bool
+		err := other.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, testLockID).Scan(&acquired)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return acquired
+	}
+	unlock := func(t *testing.T) {
+		t.Helper()
+
+		_, err := other.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, testLockID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("skips while held elsewhere", func(t *testing.T) {
+		if !tryLock(t) {
+			t.Fatal("couldn't take the lock")
+		}
+		defer unlock(t)
+
+		ran := false
+		acquired, err := models.WithAdvisoryLock(ctx, testLockID, func() error {
+			ran = true
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acquired || ran {
+			t.Errorf("acquired = %v, ran = %v, want neither", acquired, ran)
+		}
+	})
+
+	t.Run("runs and releases", func(t *testing.T) {
+		heldDuring := false
+		acquired, err := models.WithAdvisoryLock(ctx, testLockID, func() error {
+			// a second attempt while fn runs is skipped
+			heldDuring = !tryLock(t)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !acquired {
+			t.Fatal("lock not acquired")
+		}
+		if !heldDuring {
+			t.Error("lock wasn't held while fn ran")
+		}
+
+		if !tryLock(t) {
+			t.Fatal("lock still held after fn returned")
+		}
+		unlock(t)
+	})
+
+	t.Run("releases after an error", func(t *testing.T) {
+		errFn := errors.New("fn failed")
+
+		acquired, err := models.WithAdvisoryLock(ctx, testLockID, func() error {
+			return errFn
+		})
+		if !acquired || !errors.Is(err, errFn) {
+			t.Fatalf("got %v, %v, want true, %v", acquired, err, errFn)
+		}
+
+		if !tryLock(t) {
+			t.Fatal("lock still held after fn failed")
+		}
+		unlock(t)
+	})
+}
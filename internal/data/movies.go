@@ -23,11 +23,37 @@ type Movie struct {
 	Genres  []string `json:"genres,omitempty"`  // Slice of genres for the movie (romance, comedy, etc.)
 	Version int32    `json:"version"`           // The version number starts at 1 and will be incremented each
 	// time the movie information is updated
+	CreatedBy int64 `json:"-"` // ID of the user who added the movie, 0 if unknown
+	UpdatedBy int64 `json:"-"` // ID of the user who last changed the movie, 0 if unknown
+	// only set for moderators, see MovieOwner
+	Owner *MovieOwner `json:"owner,omitempty"`
 }
 
-// struct wraps a conn. pool
+// ownership info exposed in the movie JSON for moderators
+type MovieOwner struct {
+	CreatedBy int64 `json:"created_by,omitempty"`
+	UpdatedBy int64 `json:"updated_by,omitempty"`
+}
+
+// fill in the Owner field from CreatedBy/UpdatedBy
+func (m *Movie) ExposeOwner() {
+	m.Owner = &MovieOwner{CreatedBy: m.CreatedBy, UpdatedBy: m.UpdatedBy}
+}
+
+// nullInt64 converts a user ID to a value that stores 0 as NULL, for the
+// created_by/updated_by columns
+func nullInt64(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id != 0}
+}
+
+// struct wraps a conn. pool (or a transaction, see WithTx())
 type MovieModel struct {
-	DB *sql.DB
+	DB DBTX
+}
+
+// return a copy of the model which runs its queries inside tx
+func (m MovieModel) WithTx(tx *sql.Tx) MovieModel {
+	return MovieModel{DB: tx}
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
@@ -48,8 +74,8 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 func (m MovieModel) Insert(movie *Movie) error {
 	// define sql query for inserting a new record in the movies table
 	// returns system-generated data
-	query := `INSERT INTO movies (title, year, runtime, genres)
-	VALUES ($1, $2, $3, $4)
+	query := `INSERT INTO movies (title, year, runtime, genres, created_by, updated_by)
+	VALUES ($1, $2, $3, $4, $5, $5)
 	RETURNING id, created_at, version`
 
 	// create an arg slice containing the values for the placeholder params
@@ -57,7 +83,10 @@ func (m MovieModel) Insert(movie *Movie) error {
 	// Declaring the slice immediately next to sql query helps
 	// make it nice and clear **what values are being used where**
 	// in the query
-	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), nullInt64(movie.CreatedBy)}
+
+	// the creator is also the first one to have touched it
+	movie.UpdatedBy = movie.CreatedBy
 
 	// create context with 3s timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -76,10 +105,11 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	}
 
 	// define sql query for retrieving data
-	query := `SELECT id, created_at, title, year, runtime, genres, version FROM movies WHERE id = $1`
+	query := `SELECT id, created_at, title, year, runtime, genres, version, created_by, updated_by FROM movies WHERE id = $1`
 
 	// declare movie struct to hold the data returned by query
 	var movie Movie
+	var createdBy, updatedBy sql.NullInt64
 
 	// query timeout using context.withtimeout() func. to create a timeout deadline
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -97,7 +127,9 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		&movie.Year,
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
-		&movie.Version)
+		&movie.Version,
+		&createdBy,
+		&updatedBy)
 
 	// err handling, if no matching movie found, scan will return
 	// a sql.errnorows
@@ -110,6 +142,9 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 			return nil, err
 		}
 	}
+	movie.CreatedBy = createdBy.Int64
+	movie.UpdatedBy = updatedBy.Int64
+
 	// otherwise return a pointer to the movie struct
 	return &movie, nil
 }
@@ -118,7 +153,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 func (m MovieModel) Update(movie *Movie) error {
 	// TODO: implement uuid for version
 	query := `UPDATE movies
-	SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
+	SET title = $1, year = $2, runtime = $3, genres = $4, updated_by = $7, version = version + 1
 	WHERE id = $5 AND VERSION =$6
 	RETURNING version`
 
@@ -130,6 +165,7 @@ func (m MovieModel) Update(movie *Movie) error {
 		pq.Array(movie.Genres),
 		movie.ID,
 		movie.Version,
+		nullInt64(movie.UpdatedBy),
 	}
 
 	// context...
@@ -186,9 +222,50 @@ func (m MovieModel) Delete(id int64) error {
 	return nil
 }
 
+// returned by DeleteOwned() for a movie someone else created
+var ErrNotOwner = errors.New("not the movie's owner")
+
+// delete a movie only if userID created it, for users who may only delete
+// their own
+// the ownership check is part of the delete, so it can't go stale in
+// between, ErrRecordNotFound if there's no such movie
+func (m MovieModel) DeleteOwned(id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	// the SELECT sees the table as it was before the delete, so it says
+	// whether the movie was there at all
+	query := `WITH deleted AS (
+		DELETE FROM movies
+		WHERE id = $1 AND created_by = $2
+		RETURNING id
+	)
+	SELECT EXISTS (SELECT 1 FROM deleted), EXISTS (SELECT 1 FROM movies WHERE id = $1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var deleted, found bool
+
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(&deleted, &found)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case deleted:
+		return nil
+	case found:
+		return ErrNotOwner
+	default:
+		return ErrRecordNotFound
+	}
+}
+
 // GetAll func, returns a slice of movies
 func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
-	query := fmt.Sprintf(`SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+	query := fmt.Sprintf(`SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version, created_by, updated_by
 	FROM movies
 	WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
 	AND (genres @> $2 OR $2 = '{}')
@@ -218,6 +295,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	for rows.Next() {
 		// init. empty movie struct
 		var movie Movie
+		var createdBy, updatedBy sql.NullInt64
 
 		// scan values from row into Movie struct
 		err := rows.Scan(
@@ -229,10 +307,14 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
 			&movie.Version,
+			&createdBy,
+			&updatedBy,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
+		movie.CreatedBy = createdBy.Int64
+		movie.UpdatedBy = updatedBy.Int64
 		// add Movie struct to slice
 		movies = append(movies, &movie)
 	}
@@ -246,3 +328,51 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	// slice should be returned if everything ok
 	return movies, metadata, nil
 }
+
+// return every movie the user created or last updated
+func (m MovieModel) GetAllForUser(userID int64) ([]*Movie, error) {
+	query := `SELECT id, created_at, title, year, runtime, genres, version, created_by, updated_by
+	FROM movies
+	WHERE created_by = $1 OR updated_by = $1
+	ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+		var createdBy, updatedBy sql.NullInt64
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&createdBy,
+			&updatedBy,
+		)
+		if err != nil {
+			return nil, err
+		}
+		movie.CreatedBy = createdBy.Int64
+		movie.UpdatedBy = updatedBy.Int64
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return movies, nil
+}
@@ -0,0 +1,39 @@
+package data
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMovieDeleteOwned(t *testing.T) {
+	db := newTestDB(t)
+	models := NewModels(db, nil)
+
+	owner := newTestUser(t, models)
+	other := newTestUser(t, models)
+
+	movie := &Movie{Title: "Delete Test", Year: 2000, Runtime: 90, Genres: []string{"test"}, CreatedBy: owner.ID}
+	err := models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(`DELETE FROM movies WHERE id = $1`, movie.ID) })
+
+	err = models.Movies.DeleteOwned(movie.ID, other.ID)
+	if !errors.Is(err, ErrNotOwner) {
+		t.Fatalf("someone else's movie: got %v, want ErrNotOwner", err)
+	}
+	if _, err = models.Movies.Get(movie.ID); err != nil {
+		t.Fatalf("movie gone after a refused delete: %v", err)
+	}
+
+	err = models.Movies.DeleteOwned(movie.ID, owner.ID)
+	if err != nil {
+		t.Fatalf("own movie: %v", err)
+	}
+
+	err = models.Movies.DeleteOwned(movie.ID, owner.ID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("deleted movie: got %v, want ErrRecordNotFound", err)
+	}
+}
@@ -0,0 +1,395 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/meistens/api_practice/internal/validator"
+)
+
+// a third-party application registered to use the OAuth endpoints
+// scopes are the permission codes the client may ask users for, and the
+// ones its service account holds for the client credentials grant
+type OAuthClient struct {
+	ID           int64       `json:"id"`
+	ClientID     string      `json:"client_id"`
+	Secret       string      `json:"client_secret,omitempty"`
+	SecretHash   []byte      `json:"-"`
+	Name         string      `json:"name"`
+	RedirectURIs []string    `json:"redirect_uris"`
+	Scopes       Permissions `json:"scopes"`
+	Confidential bool        `json:"confidential"`
+	// service account used by the client credentials grant, 0 for public
+	// clients
+	UserID    int64     `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// check a client secret, public clients never match
+func (c *OAuthClient) SecretMatches(secret string) bool {
+	if c.SecretHash == nil {
+		return false
+	}
+	hash := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(hash[:], c.SecretHash) == 1
+}
+
+// check if a redirect URI is one the client registered, which has to be an
+// exact match
+func (c *OAuthClient) HasRedirectURI(uri string) bool {
+	return validator.In(uri, c.RedirectURIs...)
+}
+
+func ValidateOAuthClient(v *validator.Validator, client *OAuthClient, known Permissions) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 200, "name", "must not be more than 200 bytes long")
+
+	v.Check(len(client.RedirectURIs) >= 1, "redirect_uris", "must contain at least 1 uri")
+	v.Check(validator.Unique(client.RedirectURIs), "redirect_uris", "must not contain duplicate values")
+	for _, uri := range client.RedirectURIs {
+		u, err := url.Parse(uri)
+		v.Check(err == nil && u.IsAbs() && u.Host != "" && u.Fragment == "", "redirect_uris", "must be absolute uris without a fragment")
+	}
+
+	v.Check(len(client.Scopes) >= 1, "scopes", "must contain at least 1 permission")
+	v.Check(validator.Unique(client.Scopes), "scopes", "must not contain duplicate values")
+	for _, code := range client.Scopes {
+		v.Check(known.Contains(code), "scopes", "unknown permission code "+code)
+	}
+}
+
+// an issued authorization code, waiting to be exchanged at the token
+// endpoint
+type OAuthCode struct {
+	Plaintext     string
+	ClientID      int64
+	UserID        int64
+	RedirectURI   string
+	Scopes        Permissions
+	CodeChallenge string
+	Expiry        time.Time
+}
+
+// the client and scopes behind an OAuth access token
+type OAuthGrant struct {
+	ClientID int64
+	Scopes   Permissions
+}
+
+// define OAuthModel type
+type OAuthModel struct {
+	DB    *sql.DB
+	Cache *AuthCache
+}
+
+// generate credentials for a new client and insert it, the returned client
+// holds the plaintext secret if it is confidential
+// a confidential client's service account is passed in as account, it's
+// inserted in the same transaction and given the client's scopes
+func (m OAuthModel) NewClient(client *OAuthClient, account *User) error {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+	client.ClientID = hex.EncodeToString(randomBytes)
+
+	if client.Confidential {
+		randomBytes = make([]byte, 32)
+		_, err = rand.Read(randomBytes)
+		if err != nil {
+			return err
+		}
+		client.Secret = base64.RawURLEncoding.EncodeToString(randomBytes)
+
+		hash := sha256.Sum256([]byte(client.Secret))
+		client.SecretHash = hash[:]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	if account != nil {
+		err = insertUser(ctx, tx, account)
+		if err != nil {
+			return err
+		}
+		err = addUserPermissions(ctx, tx, account.ID, client.Scopes)
+		if err != nil {
+			return err
+		}
+		client.UserID = account.ID
+	}
+
+	query := `INSERT INTO oauth_clients (client_id, secret_hash, name, redirect_uris, scopes, user_id)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at`
+
+	args := []any{
+		client.ClientID,
+		client.SecretHash,
+		client.Name,
+		pq.Array(client.RedirectURIs),
+		pq.Array([]string(client.Scopes)),
+		nullInt64(client.UserID),
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&client.ID, &client.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const oauthClientColumns = `id, client_id, secret_hash, name, redirect_uris, scopes, COALESCE(user_id, 0), created_at`
+
+func scanOAuthClient(row interface{ Scan(...any) error }) (*OAuthClient, error) {
+	var (
+		client OAuthClient
+		scopes []string
+	)
+
+	err := row.Scan(
+		&client.ID,
+		&client.ClientID,
+		&client.SecretHash,
+		&client.Name,
+		pq.Array(&client.RedirectURIs),
+		pq.Array(&scopes),
+		&client.UserID,
+		&client.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	client.Scopes = Permissions(scopes)
+	client.Confidential = client.SecretHash != nil
+	return &client, nil
+}
+
+// retrieve a client by its public client_id
+func (m OAuthModel) GetClient(clientID string) (*OAuthClient, error) {
+	query := `SELECT ` + oauthClientColumns + `
+	FROM oauth_clients
+	WHERE client_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	client, err := scanOAuthClient(m.DB.QueryRowContext(ctx, query, clientID))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// list every registered client, without secrets
+func (m OAuthModel) GetAllClients() ([]*OAuthClient, error) {
+	query := `SELECT ` + oauthClientColumns + `
+	FROM oauth_clients
+	ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*OAuthClient{}
+
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// remove a client along with its service account, which cascades to every
+// code and token issued to it
+func (m OAuthModel) DeleteClient(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	var userID sql.NullInt64
+
+	err = tx.QueryRowContext(ctx, `DELETE FROM oauth_clients WHERE id = $1 RETURNING user_id`, id).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	if userID.Valid {
+		_, err = tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1 AND service_account`, userID.Int64)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if userID.Valid {
+		m.Cache.invalidateUsers(userID.Int64)
+	}
+	return nil
+}
+
+// generate and store an authorization code, the returned code holds the
+// plaintext
+func (m OAuthModel) NewCode(code *OAuthCode, ttl time.Duration) error {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+	code.Plaintext = base64.RawURLEncoding.EncodeToString(randomBytes)
+	code.Expiry = time.Now().Add(ttl)
+
+	hash := sha256.Sum256([]byte(code.Plaintext))
+
+	query := `INSERT INTO oauth_codes (hash, client_id, user_id, redirect_uri, scopes, code_challenge, expiry)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	args := []any{hash[:], code.ClientID, code.UserID, code.RedirectURI, pq.Array([]string(code.Scopes)), code.CodeChallenge, code.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// look up an unexpired authorization code and delete it in the same
+// statement, so it can only be exchanged once
+func (m OAuthModel) ConsumeCode(plaintext string) (*OAuthCode, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `DELETE FROM oauth_codes
+	WHERE hash = $1 AND expiry > NOW()
+	RETURNING client_id, user_id, redirect_uri, scopes, code_challenge, expiry`
+
+	var (
+		code   OAuthCode
+		scopes []string
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(
+		&code.ClientID,
+		&code.UserID,
+		&code.RedirectURI,
+		pq.Array(&scopes),
+		&code.CodeChallenge,
+		&code.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	code.Plaintext = plaintext
+	code.Scopes = Permissions(scopes)
+	return &code, nil
+}
+
+// retrieve the user behind an unexpired OAuth access token, along with the
+// client it was issued to and its scopes
+func (m OAuthModel) GetForAccessToken(plaintext string) (*User, *OAuthGrant, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version, users.deletion_scheduled_at, users.service_account, users.totp_enabled, users.suspended_at,
+		tokens.oauth_client_id, tokens.oauth_scopes
+	FROM users
+	INNER JOIN tokens ON users.id = tokens.user_id
+	WHERE tokens.hash = $1
+	AND tokens.scope = $2
+	AND tokens.expiry > $3`
+
+	var (
+		user   User
+		grant  OAuthGrant
+		scopes []string
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], ScopeOAuth, time.Now()).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.DeletionScheduledAt,
+		&user.ServiceAccount,
+		&user.TwoFactorEnabled,
+		&user.SuspendedAt,
+		&grant.ClientID,
+		pq.Array(&scopes),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	grant.Scopes = Permissions(scopes)
+	return &user, &grant, nil
+}
@@ -0,0 +1,173 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// password hashes are stored in the PHC string format, which carries the
+// algorithm and its parameters along with the hash, e.g.
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+//
+// new hashes are always argon2id, bcrypt hashes ($2a$, $2b$...) from
+// before the switch are still accepted and replaced on the next login
+
+// returned when a stored hash isn't in a format we know
+var ErrUnknownHashFormat = errors.New("unknown password hash format")
+
+// Argon2Params are the argon2id parameters new hashes are made with
+type Argon2Params struct {
+	// memory in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follow the x/crypto/argon2 recommendation of 64MiB
+// of memory, with a few more passes
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// the parameters in use, only changed at startup
+var passwordParams = DefaultArgon2Params
+
+// set the argon2id parameters new hashes are made with, hashes made with
+// different ones are reported as outdated by Matches()
+func SetPasswordParams(params Argon2Params) {
+	passwordParams = params
+}
+
+var b64 = base64.RawStdEncoding
+
+func argon2Hash(plaintext string, params Argon2Params) ([]byte, error) {
+	salt := make([]byte, params.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(plaintext), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Iterations, params.Parallelism,
+		b64.EncodeToString(salt), b64.EncodeToString(key))
+
+	return []byte(encoded), nil
+}
+
+// split an encoded argon2id hash into its parameters, salt and key
+func decodeArgon2Hash(encoded []byte) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+
+	parts := strings.Split(string(encoded), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+
+	if parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+
+	// Sscanf ignores anything after the last value, so check the parameters
+	// read back the same
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil || parts[3] != fmt.Sprintf("m=%d,t=%d,p=%d", params.Memory, params.Iterations, params.Parallelism) {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+	// argon2.IDKey() panics on these
+	if params.Iterations < 1 || params.Parallelism < 1 {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+
+	// an empty key would match every password
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil || len(salt) == 0 {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
+
+// set() calculates the argon2id hash of plaintext password
+// stores both hash and plaintext in struct
+func (p *password) Set(plaintextPassword string) error {
+	hash, err := argon2Hash(plaintextPassword, passwordParams)
+	if err != nil {
+		return err
+	}
+	p.plaintext = &plaintextPassword
+	p.hash = hash
+
+	return nil
+}
+
+// matches() method checks if the provided plaintext matches the
+// hashed password stored in the struct, returning true if it
+// matches and false if it doesn't
+// outdated is true when the password matched but the hash was made with
+// bcrypt or different argon2id parameters, the caller should Set() the
+// password again and save the user
+func (p *password) Matches(plaintextPassword string) (match, outdated bool, err error) {
+	if bytes.HasPrefix(p.hash, []byte("$2")) {
+		// bcrypt only looks at the first 72 bytes, and passwords used to be
+		// limited to that, so anything longer can't be right
+		if len(plaintextPassword) > 72 {
+			return false, false, nil
+		}
+
+		err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
+		if err != nil {
+			switch {
+			case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+				return false, false, nil
+			default:
+				return false, false, err
+			}
+		}
+		return true, true, nil
+	}
+
+	params, salt, key, err := decodeArgon2Hash(p.hash)
+	if err != nil {
+		return false, false, err
+	}
+
+	other := argon2.IDKey([]byte(plaintextPassword), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return false, false, nil
+	}
+	return true, params != passwordParams, nil
+}
+
+// salt for SimulatePasswordMatch, what it is doesn't matter
+var simulatedSalt = make([]byte, DefaultArgon2Params.SaltLength)
+
+// do the work of checking a password against a hash made with the current
+// parameters, so a login for an account which doesn't exist takes as long
+// as a wrong password for one which does
+func SimulatePasswordMatch(plaintextPassword string) {
+	argon2.IDKey([]byte(plaintextPassword), simulatedSalt, passwordParams.Iterations, passwordParams.Memory, passwordParams.Parallelism, passwordParams.KeyLength)
+}
@@ -0,0 +1,233 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheap parameters so the tests don't spend their time hashing
+var testArgon2Params = Argon2Params{
+	Memory:      64,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func setTestPasswordParams(t *testing.T, params Argon2Params) {
+	t.Helper()
+
+	previous := passwordParams
+	SetPasswordParams(params)
+	t.Cleanup(func() { SetPasswordParams(previous) })
+}
+
+func TestPasswordMatches(t *testing.T) {
+	setTestPasswordParams(t, testArgon2Params)
+
+	var p password
+	if err := p.Set("pa55word"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(p.hash), "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("hash %q isn't argon2id with the current parameters", p.hash)
+	}
+
+	tests := []struct {
+		plaintext string
+		want      bool
+	}{
+		{"pa55word", true},
+		{"pa55wor", false},
+		{"PA55WORD", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		match, outdated, err := p.Matches(tt.plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match != tt.want || outdated {
+			t.Errorf("Matches(%q) = %t, %t, want %t, false", tt.plaintext, match, outdated, tt.want)
+		}
+	}
+}
+
+func TestPasswordMatchesBcrypt(t *testing.T) {
+	setTestPasswordParams(t, testArgon2Params)
+
+	long := strings.Repeat("a", 72)
+
+	tests := []struct {
+		name      string
+		stored    string
+		plaintext string
+		match     bool
+	}{
+		{"right password", "pa55word", "pa55word", true},
+		{"wrong password", "pa55word", "password", false},
+		{"72 bytes", long, long, true},
+		// bcrypt would ignore the extra byte
+		{"over 72 bytes", long, long + "b", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, err := bcrypt.GenerateFromPassword([]byte(tt.stored), bcrypt.MinCost)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := password{hash: hash}
+
+			match, outdated, err := p.Matches(tt.plaintext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a bcrypt hash is always outdated, but only worth replacing
+			// once the password is known
+			if match != tt.match || outdated != tt.match {
+				t.Errorf("Matches() = %t, %t, want %t, %t", match, outdated, tt.match, tt.match)
+			}
+		})
+	}
+
+	t.Run("rehashed", func(t *testing.T) {
+		hash, err := bcrypt.GenerateFromPassword([]byte("pa55word"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := password{hash: hash}
+
+		if err := p.Set("pa55word"); err != nil {
+			t.Fatal(err)
+		}
+		match, outdated, err := p.Matches("pa55word")
+		if err != nil || !match || outdated {
+			t.Errorf("Matches() after Set() = %t, %t, %v, want true, false, nil", match, outdated, err)
+		}
+	})
+}
+
+func TestPasswordMatchesOutdated(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Argon2Params)
+	}{
+		{"memory", func(p *Argon2Params) { p.Memory *= 2 }},
+		{"iterations", func(p *Argon2Params) { p.Iterations++ }},
+		{"parallelism", func(p *Argon2Params) { p.Parallelism++ }},
+		{"salt length", func(p *Argon2Params) { p.SaltLength = 32 }},
+		{"key length", func(p *Argon2Params) { p.KeyLength = 64 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestPasswordParams(t, testArgon2Params)
+
+			var p password
+			if err := p.Set("pa55word"); err != nil {
+				t.Fatal(err)
+			}
+
+			params := testArgon2Params
+			tt.change(&params)
+			SetPasswordParams(params)
+
+			match, outdated, err := p.Matches("pa55word")
+			if err != nil || !match || !outdated {
+				t.Errorf("Matches() = %t, %t, %v, want true, true, nil", match, outdated, err)
+			}
+
+			// a wrong password doesn't need rehashing
+			match, outdated, err = p.Matches("password")
+			if err != nil || match || outdated {
+				t.Errorf("Matches() wrong password = %t, %t, %v, want false, false, nil", match, outdated, err)
+			}
+		})
+	}
+}
+
+func TestPasswordMatchesMalformed(t *testing.T) {
+	setTestPasswordParams(t, testArgon2Params)
+
+	var p password
+	if err := p.Set("pa55word"); err != nil {
+		t.Fatal(err)
+	}
+	valid := string(p.hash)
+	parts := strings.Split(valid, "$")
+
+	// salt and key of the valid hash, for building the broken ones
+	salt, key := parts[4], parts[5]
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"empty", ""},
+		{"plaintext", "pa55word"},
+		{"argon2i", "$argon2i$v=19$m=64,t=1,p=1$" + salt + "$" + key},
+		{"argon2d", "$argon2d$v=19$m=64,t=1,p=1$" + salt + "$" + key},
+		{"scrypt", "$scrypt$ln=16,r=8,p=1$" + salt + "$" + key},
+		{"old version", "$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key},
+		{"no version", "$argon2id$m=64,t=1,p=1$" + salt + "$" + key},
+		{"version junk", "$argon2id$v=19x$m=64,t=1,p=1$" + salt + "$" + key},
+		{"parameters out of order", "$argon2id$v=19$t=1,m=64,p=1$" + salt + "$" + key},
+		{"parameters junk", "$argon2id$v=19$m=64,t=1,p=1,x=2$" + salt + "$" + key},
+		{"missing parameter", "$argon2id$v=19$m=64,t=1$" + salt + "$" + key},
+		{"no iterations", "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key},
+		{"no parallelism", "$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key},
+		{"parallelism out of range", "$argon2id$v=19$m=64,t=1,p=256$" + salt + "$" + key},
+		{"negative memory", "$argon2id$v=19$m=-64,t=1,p=1$" + salt + "$" + key},
+		{"salt not base64", "$argon2id$v=19$m=64,t=1,p=1$!!!$" + key},
+		{"key not base64", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$!!!"},
+		{"padded base64", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + key + "="},
+		{"empty salt", "$argon2id$v=19$m=64,t=1,p=1$$" + key},
+		{"empty key", "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$"},
+		{"no key", "$argon2id$v=19$m=64,t=1,p=1$" + salt},
+		{"truncated parameters", valid[:len("$argon2id$v=19$m=64,t=1")]},
+		{"extra field", valid + "$" + key},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := password{hash: []byte(tt.hash)}
+
+			match, outdated, err := p.Matches("pa55word")
+			if !errors.Is(err, ErrUnknownHashFormat) {
+				t.Errorf("got error %v, want ErrUnknownHashFormat", err)
+			}
+			if match || outdated {
+				t.Errorf("Matches() = %t, %t, want false, false", match, outdated)
+			}
+		})
+	}
+
+	t.Run("truncated bcrypt", func(t *testing.T) {
+		p := password{hash: []byte("$2a$10$N9qo8uLOickgx2ZMRZoMye")}
+
+		match, _, err := p.Matches("pa55word")
+		if err == nil || match {
+			t.Errorf("Matches() = %t, %v, want false and an error", match, err)
+		}
+	})
+}
+
+func TestDecodeArgon2Hash(t *testing.T) {
+	params, salt, key, err := decodeArgon2Hash([]byte("$argon2id$v=19$m=65536,t=3,p=2$c29tZXNhbHQ$a2V5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Argon2Params{Memory: 65536, Iterations: 3, Parallelism: 2, SaltLength: 8, KeyLength: 3}
+	if params != want {
+		t.Errorf("params = %+v, want %+v", params, want)
+	}
+	if string(salt) != "somesalt" || string(key) != "key" {
+		t.Errorf("salt, key = %q, %q, want \"somesalt\", \"key\"", salt, key)
+	}
+}
@@ -3,6 +3,7 @@ package data
 import (
 	"context"
 	"database/sql"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
@@ -10,38 +11,258 @@ import (
 
 // define a permissions slice to hold the permission codes (read and write) for a
 // single user
+//
+// codes are parts separated by colons, and a code covers everything below
+// it, so movies:write covers movies:write:own. a * part matches any one
+// part, or everything below it when it comes last, so movies:* covers every
+// movies code and *:read every read code. entries starting with - deny the
+// code instead, which wins over anything granting it
 type Permissions []string
 
-// helper method to check if the permissions slice contains a specific
-// permission code
+// deny entries start with this
+const denyPrefix = "-"
+
+// split an entry into the code it's for and whether it denies it
+func parseEntry(entry string) (string, bool) {
+	if strings.HasPrefix(entry, denyPrefix) {
+		return entry[len(denyPrefix):], true
+	}
+	return entry, false
+}
+
+// check if a granted code, which can contain wildcards, covers the code
+func matchCode(granted, code string) bool {
+	g := strings.Split(granted, ":")
+	c := strings.Split(code, ":")
+	if len(g) > len(c) {
+		return false
+	}
+	for i := range g {
+		if g[i] != "*" && g[i] != c[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// helper method to check if the permissions slice grants a specific
+// permission code, through an entry which covers it and no deny entry
+// which covers it
 func (p Permissions) Include(code string) bool {
+	allowed := false
+	for _, entry := range p {
+		granted, deny := parseEntry(entry)
+		if !matchCode(granted, code) {
+			continue
+		}
+		if deny {
+			return false
+		}
+		allowed = true
+	}
+	return allowed
+}
+
+// check if the permissions slice grants at least one of the codes
+func (p Permissions) IncludeAny(codes ...string) bool {
+	for _, code := range codes {
+		if p.Include(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// check if the permissions slice grants every one of the codes
+func (p Permissions) IncludeAll(codes ...string) bool {
+	for _, code := range codes {
+		if !p.Include(code) {
+			return false
+		}
+	}
+	return true
+}
+
+// check if the permissions slice holds the exact entry, without any
+// wildcard matching, for looking codes up in lists rather than checking
+// access
+func (p Permissions) Contains(entry string) bool {
 	for i := range p {
-		if code == p[i] {
+		if entry == p[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// check if the entry is one of the codes in p, or denies one, for
+// validating entries against every code known to the system
+func (p Permissions) Defines(entry string) bool {
+	code, _ := parseEntry(entry)
+	return p.Contains(code)
+}
+
+// copy of the permissions slice with the given entries left out
+func (p Permissions) Without(entries ...string) Permissions {
+	kept := Permissions{}
+	for _, entry := range p {
+		if !Permissions(entries).Contains(entry) {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// copy of the permissions slice which also denies the given codes
+func (p Permissions) Deny(codes ...string) Permissions {
+	denied := append(Permissions{}, p...)
+	for _, code := range codes {
+		denied = append(denied, denyPrefix+code)
+	}
+	return denied
+}
+
+// the codes in scopes which the permissions slice grants, along with its
+// deny entries so they still apply when a scope is a wildcard
+func (p Permissions) Restrict(scopes Permissions) Permissions {
+	restricted := Permissions{}
+	for _, code := range scopes {
+		if p.Include(code) {
+			restricted = append(restricted, code)
+		}
+	}
+	for _, entry := range p {
+		if _, deny := parseEntry(entry); deny {
+			restricted = append(restricted, entry)
+		}
+	}
+	return restricted
+}
+
+// check if someone holding the permissions slice may hand the entry out,
+// or take it away, which needs the code it grants or denies. the wildcards
+// covering every admin permission, * and *:admin, need * as well
+func (p Permissions) CanDelegate(entry string) bool {
+	code, _ := parseEntry(entry)
+	if matchCode(code, "*:admin") && !p.Include("*") {
+		return false
+	}
+	return p.Include(code)
+}
+
+// something a request's permissions have to satisfy, a single Code or a
+// combination made with AnyOf() and AllOf()
+type Requirement interface {
+	SatisfiedBy(p Permissions) bool
+}
+
+// a requirement for a single permission code
+type Code string
+
+func (c Code) SatisfiedBy(p Permissions) bool {
+	return p.Include(string(c))
+}
+
+type anyOf []Requirement
+
+func (reqs anyOf) SatisfiedBy(p Permissions) bool {
+	for _, req := range reqs {
+		if req.SatisfiedBy(p) {
 			return true
 		}
 	}
 	return false
 }
 
+type allOf []Requirement
+
+func (reqs allOf) SatisfiedBy(p Permissions) bool {
+	for _, req := range reqs {
+		if !req.SatisfiedBy(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// a requirement met by meeting any one of reqs
+func AnyOf(reqs ...Requirement) Requirement {
+	return anyOf(reqs)
+}
+
+// a requirement met by meeting every one of reqs
+func AllOf(reqs ...Requirement) Requirement {
+	return allOf(reqs)
+}
+
 // define PermissionModel type
 type PermissionModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Cache *AuthCache
 }
 
 // func. returns all permission codes for a specific user in the Permissions slice
+// that's the ones granted to them directly along with the ones from
+// their roles, deny entries included
 func (m PermissionModel) GetAllUserPerms(userID int64) (Permissions, error) {
+	if permissions, found := m.Cache.getPermissions(userID); found {
+		return permissions, nil
+	}
+	generation := m.Cache.currentGeneration()
+
+	query := `
+	SELECT CASE WHEN users_permissions.deny THEN '-' ELSE '' END || permissions.code AS code
+	FROM permissions
+	INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+	WHERE users_permissions.user_id = $1
+	UNION
+	SELECT CASE WHEN roles_permissions.deny THEN '-' ELSE '' END || permissions.code AS code
+	FROM permissions
+	INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+	INNER JOIN user_roles ON user_roles.role_id = roles_permissions.role_id
+	WHERE user_roles.user_id = $1
+	ORDER BY code
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	permissions, err := m.queryCodes(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Cache.setPermissions(userID, permissions, generation)
+	return permissions, nil
+}
+
+// the permissions GetAllUserPerms() would return once the user lost a role,
+// for checking an admin doesn't lock themselves out by giving theirs up
+// it isn't cached
+func (m PermissionModel) GetAllUserPermsWithoutRole(userID, roleID int64) (Permissions, error) {
 	query := `
-	SELECT permissions.code
+	SELECT CASE WHEN users_permissions.deny THEN '-' ELSE '' END || permissions.code AS code
 	FROM permissions
 	INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-	INNER JOIN users ON users_permissions.user_id = users.id
-	WHERE users.id = $1
+	WHERE users_permissions.user_id = $1
+	UNION
+	SELECT CASE WHEN roles_permissions.deny THEN '-' ELSE '' END || permissions.code AS code
+	FROM permissions
+	INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+	INNER JOIN user_roles ON user_roles.role_id = roles_permissions.role_id
+	WHERE user_roles.user_id = $1 AND user_roles.role_id <> $2
+	ORDER BY code
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query, userID)
+	return m.queryCodes(ctx, query, userID, roleID)
+}
+
+// run a query selecting permission entries, one per row
+func (m PermissionModel) queryCodes(ctx context.Context, query string, args ...any) (Permissions, error) {
+	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -66,14 +287,84 @@ func (m PermissionModel) GetAllUserPerms(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
-// add provided perm. codes for a specific user
+// add provided perm. codes for a specific user, codes the user already
+// holds are skipped, and a deny entry replaces a grant of the same code or
+// the other way round
 func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
-	query := `INSERT INTO users_permissions
-	SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := addUserPermissions(ctx, m.DB, userID, codes)
+	if err != nil {
+		return err
+	}
+
+	m.Cache.invalidateUsers(userID)
+	return nil
+}
+
+// shared by AddForUser() and OAuthModel.NewClient(), which runs it inside a
+// transaction
+func addUserPermissions(ctx context.Context, db DBTX, userID int64, codes []string) error {
+	query := `INSERT INTO users_permissions (user_id, permission_id, deny)
+	SELECT $1, permissions.id, entry <> permissions.code
+	FROM permissions, unnest($2::text[]) AS entry
+	WHERE entry IN (permissions.code, '-' || permissions.code)
+	ON CONFLICT (user_id, permission_id) DO UPDATE SET deny = EXCLUDED.deny`
+
+	_, err := db.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
+
+// remove the provided perm. codes from a specific user, a deny entry only
+// removes a deny
+func (m PermissionModel) RemoveForUser(userID int64, codes ...string) error {
+	query := `DELETE FROM users_permissions
+	USING permissions
+	WHERE users_permissions.permission_id = permissions.id
+	AND users_permissions.user_id = $1
+	AND CASE WHEN users_permissions.deny THEN '-' ELSE '' END || permissions.code = ANY($2)`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
-	return err
+	if err != nil {
+		return err
+	}
+
+	m.Cache.invalidateUsers(userID)
+	return nil
+}
+
+// return every permission code known to the system, wildcards included
+func (m PermissionModel) GetAll() (Permissions, error) {
+	query := `SELECT code FROM permissions ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
 }
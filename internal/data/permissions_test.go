@@ -0,0 +1,258 @@
+package data
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPermissionsInclude(t *testing.T) {
+	tests := []struct {
+		name string
+		held Permissions
+		code string
+		want bool
+	}{
+		{"exact", Permissions{"movies:read"}, "movies:read", true},
+		{"other code", Permissions{"movies:read"}, "movies:write", false},
+		{"nothing held", Permissions{}, "movies:read", false},
+		{"nil", nil, "movies:read", false},
+		{"other resource", Permissions{"movies:read"}, "users:read", false},
+
+		{"parent covers child", Permissions{"movies:write"}, "movies:write:own", true},
+		{"parent covers grandchild", Permissions{"movies"}, "movies:write:own", true},
+		{"child doesn't cover parent", Permissions{"movies:write:own"}, "movies:write", false},
+		{"prefix is per part", Permissions{"movies:wr"}, "movies:write", false},
+
+		{"resource wildcard", Permissions{"movies:*"}, "movies:write", true},
+		{"resource wildcard below", Permissions{"movies:*"}, "movies:write:own", true},
+		{"resource wildcard other resource", Permissions{"movies:*"}, "users:admin", false},
+		{"resource wildcard needs a part", Permissions{"movies:*"}, "movies", false},
+
+		{"action wildcard", Permissions{"*:read"}, "movies:read", true},
+		{"action wildcard other resource", Permissions{"*:read"}, "users:read", true},
+		{"action wildcard other action", Permissions{"*:read"}, "movies:write", false},
+		{"action wildcard below", Permissions{"*:read"}, "movies:read:own", true},
+		{"admin wildcard", Permissions{"*:admin"}, "roles:admin", true},
+
+		{"everything", Permissions{"*"}, "movies:write", true},
+		{"everything single part", Permissions{"*"}, "movies", true},
+		{"everything deep", Permissions{"*"}, "a:b:c:d", true},
+
+		{"deny wins", Permissions{"movies:write", "-movies:write"}, "movies:write", false},
+		{"deny wins whatever the order", Permissions{"-movies:write", "movies:write"}, "movies:write", false},
+		{"deny wins over wildcard", Permissions{"*", "-users:admin"}, "users:admin", false},
+		{"deny leaves the rest", Permissions{"*", "-users:admin"}, "movies:write", true},
+		{"deny covers children", Permissions{"movies:write", "-movies:write"}, "movies:write:own", false},
+		{"deny child leaves parent", Permissions{"movies:write", "-movies:write:own"}, "movies:write", true},
+		{"wildcard deny", Permissions{"*", "-*:admin"}, "roles:admin", false},
+		{"deny alone grants nothing", Permissions{"-movies:write"}, "movies:read", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.held.Include(tt.code); got != tt.want {
+				t.Errorf("%v.Include(%q) = %v, want %v", tt.held, tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPermissionsIncludeAnyAll(t *testing.T) {
+	held := Permissions{"movies:read", "-movies:write"}
+
+	tests := []struct {
+		name    string
+		codes   []string
+		wantAny bool
+		wantAll bool
+	}{
+		{"none", nil, false, true},
+		{"one held", []string{"movies:read"}, true, true},
+		{"held and not", []string{"movies:read", "users:admin"}, true, false},
+		{"held and denied", []string{"movies:read", "movies:write"}, true, false},
+		{"none held", []string{"users:admin", "movies:write"}, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := held.IncludeAny(tt.codes...); got != tt.wantAny {
+				t.Errorf("IncludeAny(%v) = %v, want %v", tt.codes, got, tt.wantAny)
+			}
+			if got := held.IncludeAll(tt.codes...); got != tt.wantAll {
+				t.Errorf("IncludeAll(%v) = %v, want %v", tt.codes, got, tt.wantAll)
+			}
+		})
+	}
+}
+
+func TestRequirements(t *testing.T) {
+	movieWrite := AnyOf(Code("movies:write"), Code("movies:write:own"))
+
+	tests := []struct {
+		name string
+		req  Requirement
+		held Permissions
+		want bool
+	}{
+		{"code", Code("movies:read"), Permissions{"movies:read"}, true},
+		{"code through wildcard", Code("movies:read"), Permissions{"*:read"}, true},
+		{"code denied", Code("movies:read"), Permissions{"*", "-movies"}, false},
+
+		{"any first", movieWrite, Permissions{"movies:write"}, true},
+		{"any second", movieWrite, Permissions{"movies:write:own"}, true},
+		{"any neither", movieWrite, Permissions{"movies:read"}, false},
+		{"any with one denied", movieWrite, Permissions{"movies:*", "-movies:write"}, false},
+		{"any with a child denied", movieWrite, Permissions{"movies:*", "-movies:write:own"}, true},
+		{"any empty", AnyOf(), Permissions{"*"}, false},
+
+		{"all", AllOf(Code("movies:read"), Code("users:admin")), Permissions{"movies:read", "users:admin"}, true},
+		{"all missing one", AllOf(Code("movies:read"), Code("users:admin")), Permissions{"movies:read"}, false},
+		{"all with one denied", AllOf(Code("movies:read"), Code("users:admin")), Permissions{"*", "-users"}, false},
+		{"all empty", AllOf(), Permissions{}, true},
+
+		{"nested", AllOf(Code("movies:read"), movieWrite), Permissions{"*:read", "movies:write:own"}, true},
+		{"nested missing", AllOf(Code("movies:read"), movieWrite), Permissions{"*:read"}, false},
+		{"nested any of all", AnyOf(AllOf(Code("a"), Code("b")), Code("c")), Permissions{"a", "c"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.req.SatisfiedBy(tt.held); got != tt.want {
+				t.Errorf("SatisfiedBy(%v) = %v, want %v", tt.held, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPermissionsExactLookups(t *testing.T) {
+	known := Permissions{"movies:read", "movies:*", "*"}
+
+	tests := []struct {
+		entry       string
+		wantContain bool
+		wantDefine  bool
+	}{
+		{"movies:read", true, true},
+		{"-movies:read", false, true},
+		{"movies:*", true, true},
+		{"movies:write", false, false},
+		{"-movies:write", false, false},
+		// no wildcard matching, * in known doesn't make every code known
+		{"users:admin", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			if got := known.Contains(tt.entry); got != tt.wantContain {
+				t.Errorf("Contains(%q) = %v, want %v", tt.entry, got, tt.wantContain)
+			}
+			if got := known.Defines(tt.entry); got != tt.wantDefine {
+				t.Errorf("Defines(%q) = %v, want %v", tt.entry, got, tt.wantDefine)
+			}
+		})
+	}
+}
+
+func TestPermissionsWithoutDeny(t *testing.T) {
+	held := Permissions{"*", "movies:read", "-users:admin"}
+
+	tests := []struct {
+		name string
+		got  Permissions
+		want Permissions
+	}{
+		{"without exact", held.Without("movies:read"), Permissions{"*", "-users:admin"}},
+		{"without is exact", held.Without("movies:*"), Permissions{"*", "movies:read", "-users:admin"}},
+		{"without a deny", held.Without("-users:admin"), Permissions{"*", "movies:read"}},
+		{"without several", held.Without("*", "-users:admin"), Permissions{"movies:read"}},
+		{"without nothing", held.Without(), Permissions{"*", "movies:read", "-users:admin"}},
+		{"deny", held.Deny("movies:write"), Permissions{"*", "movies:read", "-users:admin", "-movies:write"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !slices.Equal(tt.got, tt.want) {
+				t.Errorf("got %v, want %v", tt.got, tt.want)
+			}
+		})
+	}
+
+	// neither touches the original
+	if !slices.Equal(held, Permissions{"*", "movies:read", "-users:admin"}) {
+		t.Errorf("original changed to %v", held)
+	}
+
+	if held.Deny("movies:write").Include("movies:write") {
+		t.Error("Deny() didn't deny")
+	}
+}
+
+func TestPermissionsRestrict(t *testing.T) {
+	tests := []struct {
+		name   string
+		held   Permissions
+		scopes Permissions
+		want   Permissions
+	}{
+		{"held scopes kept", Permissions{"movies:read", "movies:write"}, Permissions{"movies:read"}, Permissions{"movies:read"}},
+		{"unheld scopes dropped", Permissions{"movies:read"}, Permissions{"movies:read", "users:admin"}, Permissions{"movies:read"}},
+		{"scope held through wildcard", Permissions{"*"}, Permissions{"movies:write"}, Permissions{"movies:write"}},
+		{"wildcard scope needs a wildcard", Permissions{"movies:read"}, Permissions{"movies:*"}, Permissions{}},
+		{"denied scope dropped", Permissions{"*", "-movies:write"}, Permissions{"movies:write"}, Permissions{"-movies:write"}},
+		{"denies carried over", Permissions{"*", "-users:admin"}, Permissions{"*"}, Permissions{"*", "-users:admin"}},
+		{"no scopes", Permissions{"*"}, Permissions{}, Permissions{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.held.Restrict(tt.scopes)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("%v.Restrict(%v) = %v, want %v", tt.held, tt.scopes, got, tt.want)
+			}
+		})
+	}
+
+	// a wildcard scope can't reach past a deny the user has
+	restricted := Permissions{"*", "-users:admin"}.Restrict(Permissions{"*"})
+	if restricted.Include("users:admin") {
+		t.Error("restricted permissions include a denied code")
+	}
+	if !restricted.Include("movies:write") {
+		t.Error("restricted permissions lost an allowed code")
+	}
+}
+
+func TestPermissionsCanDelegate(t *testing.T) {
+	tests := []struct {
+		name  string
+		held  Permissions
+		entry string
+		want  bool
+	}{
+		{"held", Permissions{"users:admin", "movies:write"}, "movies:write", true},
+		{"not held", Permissions{"users:admin"}, "movies:write", false},
+		{"held through a wildcard", Permissions{"movies:*"}, "movies:write", true},
+		{"child of a held code", Permissions{"movies:write"}, "movies:write:own", true},
+		{"parent of a held code", Permissions{"movies:write:own"}, "movies:write", false},
+		{"denied", Permissions{"*", "-roles:admin"}, "roles:admin", false},
+		{"deny entry for a held code", Permissions{"movies:write"}, "-movies:write", true},
+		{"deny entry for an unheld code", Permissions{"users:admin"}, "-roles:admin", false},
+		{"other admin permission", Permissions{"users:admin"}, "roles:admin", false},
+
+		{"everything without *", Permissions{"users:admin"}, "*", false},
+		{"every admin permission without *", Permissions{"*:admin"}, "*:admin", false},
+		{"every admin permission with *", Permissions{"*"}, "*:admin", true},
+		{"everything with *", Permissions{"*"}, "*", true},
+		{"deny everything without *", Permissions{"*:admin"}, "-*:admin", false},
+		{"resource wildcard", Permissions{"movies:*"}, "movies:*", true},
+		{"read wildcard", Permissions{"*:read"}, "*:read", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.held.CanDelegate(tt.entry); got != tt.want {
+				t.Errorf("%v.CanDelegate(%q) = %v, want %v", tt.held, tt.entry, got, tt.want)
+			}
+		})
+	}
+}
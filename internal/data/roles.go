@@ -0,0 +1,347 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/meistens/api_practice/internal/validator"
+)
+
+// returned when creating or renaming a role to a name which is taken
+var ErrDuplicateRole = errors.New("duplicate role")
+
+// role names are short identifiers, like viewer or movie-editor
+var roleNameRX = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// a named bundle of permission codes, users holding the role get all of them
+type Role struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Permissions Permissions `json:"permissions"`
+	Version     int         `json:"version"`
+}
+
+// the permission codes have to exist, known is every code in the system,
+// and a code can't be both granted and denied
+func ValidateRole(v *validator.Validator, role *Role, known Permissions) {
+	v.Check(role.Name != "", "name", "must be provided")
+	v.Check(len(role.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(validator.Matches(role.Name, roleNameRX), "name", "must only contain lowercase letters, digits, - and _")
+	v.Check(len(role.Description) <= 500, "description", "must not be more than 500 bytes long")
+	v.Check(role.Permissions != nil, "permissions", "must be provided")
+	v.Check(validator.Unique(role.Permissions), "permissions", "must not contain duplicate values")
+
+	for _, entry := range role.Permissions {
+		if !known.Defines(entry) {
+			v.AddError("permissions", "unknown permission code: "+entry)
+			break
+		}
+		if code, deny := parseEntry(entry); deny && role.Permissions.Contains(code) {
+			v.AddError("permissions", "must not both grant and deny "+code)
+			break
+		}
+	}
+}
+
+// define RoleModel type
+type RoleModel struct {
+	DB    *sql.DB
+	Cache *AuthCache
+}
+
+// the columns every role query selects, permissions are aggregated from
+// roles_permissions
+const roleColumns = `roles.id, roles.created_at, roles.name, roles.description, roles.version,
+	COALESCE(array_agg(CASE WHEN roles_permissions.deny THEN '-' ELSE '' END || permissions.code
+		ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')`
+
+const roleJoins = `FROM roles
+	LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+	LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id`
+
+func scanRole(row interface{ Scan(...any) error }) (*Role, error) {
+	var role Role
+
+	err := row.Scan(
+		&role.ID,
+		&role.CreatedAt,
+		&role.Name,
+		&role.Description,
+		&role.Version,
+		pq.Array(&role.Permissions),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// replace a role's permissions with the given codes, deny entries
+// included, inside tx
+func setRolePermissions(ctx context.Context, tx *sql.Tx, roleID int64, codes Permissions) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM roles_permissions WHERE role_id = $1`, roleID)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO roles_permissions (role_id, permission_id, deny)
+	SELECT $1, permissions.id, entry <> permissions.code
+	FROM permissions, unnest($2::text[]) AS entry
+	WHERE entry IN (permissions.code, '-' || permissions.code)`
+
+	_, err = tx.ExecContext(ctx, query, roleID, pq.Array([]string(codes)))
+	return err
+}
+
+// the unique constraint on roles.name
+func isDuplicateRole(err error) bool {
+	return err != nil && strings.Contains(err.Error(), `duplicate key value violates unique constraint "roles_name_key"`)
+}
+
+// create a role along with its permissions
+func (m RoleModel) Insert(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	query := `INSERT INTO roles (name, description)
+	VALUES ($1, $2)
+	RETURNING id, created_at, version`
+
+	err = tx.QueryRowContext(ctx, query, role.Name, role.Description).Scan(&role.ID, &role.CreatedAt, &role.Version)
+	if err != nil {
+		if isDuplicateRole(err) {
+			return ErrDuplicateRole
+		}
+		return err
+	}
+
+	err = setRolePermissions(ctx, tx, role.ID, role.Permissions)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// retrieve a role by ID
+func (m RoleModel) Get(id int64) (*Role, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT ` + roleColumns + `
+	` + roleJoins + `
+	WHERE roles.id = $1
+	GROUP BY roles.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	role, err := scanRole(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return role, nil
+}
+
+// retrieve a role by name
+func (m RoleModel) GetByName(name string) (*Role, error) {
+	query := `SELECT ` + roleColumns + `
+	` + roleJoins + `
+	WHERE roles.name = $1
+	GROUP BY roles.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	role, err := scanRole(m.DB.QueryRowContext(ctx, query, name))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return role, nil
+}
+
+// every role, ordered by name
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := `SELECT ` + roleColumns + `
+	` + roleJoins + `
+	GROUP BY roles.id
+	ORDER BY roles.name`
+
+	return m.query(query)
+}
+
+// the roles held by a user, ordered by name
+func (m RoleModel) GetAllForUser(userID int64) ([]*Role, error) {
+	query := `SELECT ` + roleColumns + `
+	` + roleJoins + `
+	WHERE roles.id IN (SELECT role_id FROM user_roles WHERE user_id = $1)
+	GROUP BY roles.id
+	ORDER BY roles.name`
+
+	return m.query(query, userID)
+}
+
+func (m RoleModel) query(query string, args ...any) ([]*Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// update a role's name, description and permissions, checking the version
+// as MovieModel.Update() does
+func (m RoleModel) Update(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	query := `UPDATE roles
+	SET name = $1, description = $2, version = version + 1
+	WHERE id = $3 AND version = $4
+	RETURNING version`
+
+	err = tx.QueryRowContext(ctx, query, role.Name, role.Description, role.ID, role.Version).Scan(&role.Version)
+	if err != nil {
+		switch {
+		case isDuplicateRole(err):
+			return ErrDuplicateRole
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	err = setRolePermissions(ctx, tx, role.ID, role.Permissions)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	// any number of users could hold the role
+	m.Cache.invalidateAllPermissions()
+	return nil
+}
+
+// delete a role, users holding it lose it through ON DELETE CASCADE
+func (m RoleModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM roles
+	WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	m.Cache.invalidateAllPermissions()
+	return nil
+}
+
+// give a user a role, giving one they already hold does nothing
+func (m RoleModel) AddForUser(userID, roleID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := addUserRole(ctx, m.DB, userID, roleID)
+	if err != nil {
+		return err
+	}
+
+	m.Cache.invalidateUsers(userID)
+	return nil
+}
+
+// the insert behind AddForUser(), also run when a user is inserted with
+// their starting roles
+func addUserRole(ctx context.Context, db DBTX, userID, roleID int64) error {
+	query := `INSERT INTO user_roles (user_id, role_id)
+	VALUES ($1, $2)
+	ON CONFLICT DO NOTHING`
+
+	_, err := db.ExecContext(ctx, query, userID, roleID)
+	return err
+}
+
+// take a role away from a user
+func (m RoleModel) RemoveForUser(userID, roleID int64) error {
+	query := `DELETE FROM user_roles
+	WHERE user_id = $1 AND role_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, roleID)
+	if err != nil {
+		return err
+	}
+
+	m.Cache.invalidateUsers(userID)
+	return nil
+}
@@ -0,0 +1,258 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// max. length of the user agent stored with a session
+const sessionUserAgentMaxLen = 512
+
+// a login session, i.e the token family created by one successful login
+// last_used_at is bumped each time the session's refresh token is rotated
+type Session struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	Current    bool      `json:"current"`
+}
+
+// client details captured when a session is created
+type SessionClient struct {
+	IP        string
+	UserAgent string
+}
+
+// define SessionModel type
+type SessionModel struct {
+	DB    *sql.DB
+	Cache *AuthCache
+}
+
+// record a new session for a token family, called inside the token
+// pair transaction
+func insertSession(ctx context.Context, db DBTX, userID int64, familyID []byte, client SessionClient) error {
+	userAgent := client.UserAgent
+	if len(userAgent) > sessionUserAgentMaxLen {
+		userAgent = userAgent[:sessionUserAgentMaxLen]
+	}
+
+	query := `INSERT INTO sessions (user_id, family_id, ip, user_agent)
+	VALUES ($1, $2, $3, $4)`
+
+	_, err := db.ExecContext(ctx, query, userID, familyID, client.IP, userAgent)
+	return err
+}
+
+// list a user's active sessions, i.e the ones which still have an unexpired
+// token, newest first
+// the session the current token belongs to is flagged as current
+func (m SessionModel) GetAllForUser(userID int64, currentTokenPlaintext string) ([]*Session, error) {
+	currentHash := sha256.Sum256([]byte(currentTokenPlaintext))
+
+	query := `SELECT id, created_at, last_used_at, ip, user_agent,
+		family_id = (SELECT family_id FROM tokens WHERE hash = $2) IS TRUE
+	FROM sessions
+	WHERE user_id = $1
+	AND EXISTS (SELECT 1 FROM tokens WHERE tokens.family_id = sessions.family_id AND tokens.expiry > NOW())
+	ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, currentHash[:])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.IP,
+			&session.UserAgent,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// when the session a token belongs to was started, i.e when the user last
+// logged in to get it
+// signed access tokens aren't in the tokens table, so their family is
+// passed in instead, tokenPlaintext is only looked up when familyID is nil
+func (m SessionModel) StartedAt(userID int64, familyID []byte, tokenPlaintext string) (time.Time, error) {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `SELECT created_at
+	FROM sessions
+	WHERE user_id = $1
+	AND family_id = COALESCE($2, (SELECT family_id FROM tokens WHERE hash = $3))`
+
+	var startedAt time.Time
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID, familyID, hash[:]).Scan(&startedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return time.Time{}, ErrRecordNotFound
+		default:
+			return time.Time{}, err
+		}
+	}
+	return startedAt, nil
+}
+
+// end one of the user's sessions, revoking every token in it, and return
+// the session's token family
+func (m SessionModel) Delete(id, userID int64) ([]byte, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	var familyID []byte
+
+	err = tx.QueryRowContext(ctx, `DELETE FROM sessions WHERE id = $1 AND user_id = $2 RETURNING family_id`, id, userID).Scan(&familyID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family_id = $1`, familyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	m.Cache.invalidateUsers(userID)
+	return familyID, nil
+}
+
+// end the session a token belongs to
+// tokens issued before sessions existed have no family, so just the token
+// itself is deleted
+func (m SessionModel) DeleteForToken(tokenPlaintext string) error {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `WITH family AS (
+		SELECT family_id FROM tokens WHERE hash = $1 AND family_id IS NOT NULL
+	), deleted_sessions AS (
+		DELETE FROM sessions WHERE family_id IN (SELECT family_id FROM family)
+	)
+	DELETE FROM tokens
+	WHERE hash = $1 OR family_id IN (SELECT family_id FROM family)
+	RETURNING user_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, hash[:])
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// one row per token, all for the same user
+	var userID int64
+	for rows.Next() {
+		if err := rows.Scan(&userID); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if userID != 0 {
+		m.Cache.invalidateUsers(userID)
+	}
+	return nil
+}
+
+// drop every session record for a user, the tokens themselves are removed
+// with TokenModel.DeleteAllForUser()
+func (m SessionModel) DeleteAllForUser(userID int64) error {
+	query := `DELETE FROM sessions
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// end the session for a token family, used for signed access tokens which
+// aren't stored in the tokens table themselves
+func (m SessionModel) DeleteForFamily(familyID []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	var userID sql.NullInt64
+
+	err = tx.QueryRowContext(ctx, `DELETE FROM sessions WHERE family_id = $1 RETURNING user_id`, familyID).Scan(&userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family_id = $1`, familyID)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if userID.Valid {
+		m.Cache.invalidateUsers(userID.Int64)
+	}
+	return nil
+}
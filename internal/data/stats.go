@@ -0,0 +1,199 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// number of recently added movies returned with the catalogue stats
+const statsNewestLimit = 5
+
+// struct holding the aggregate figures for the movie catalogue
+type MovieStats struct {
+	TotalMovies   int            `json:"total_movies"`
+	Genres        []GenreCount   `json:"genres"`
+	Decades       []DecadeCount  `json:"decades"`
+	GenreRuntimes []GenreRuntime `json:"genre_runtimes"`
+	NewestAdded   []*Movie       `json:"newest_added"`
+	GeneratedAt   time.Time      `json:"generated_at"`
+}
+
+// number of movies tagged with a single genre
+type GenreCount struct {
+	Genre string `json:"genre"`
+	Count int    `json:"count"`
+}
+
+// number of movies released within a decade, e.g 1990 for 1990-1999
+type DecadeCount struct {
+	Decade int `json:"decade"`
+	Count  int `json:"count"`
+}
+
+// average and percentile runtimes (in minutes) for a single genre
+type GenreRuntime struct {
+	Genre   string  `json:"genre"`
+	Average float64 `json:"average"`
+	P50     float64 `json:"p50"`
+	P90     float64 `json:"p90"`
+	P99     float64 `json:"p99"`
+}
+
+// define StatsModel type
+type StatsModel struct {
+	DB *sql.DB
+}
+
+// the same title/genres filter used by MovieModel.GetAll(), with the
+// title bound to $1 and genres to $2 in every stats query
+const statsFilter = `(to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+	AND (genres @> $2 OR $2 = '{}')`
+
+// compute the catalogue aggregates for the movies matching the filters
+// all queries run inside a single read-only transaction so the figures
+// are consistent with each other
+func (m StatsModel) GetMovieStats(title string, genres []string) (*MovieStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	args := []any{title, pq.Array(genres)}
+
+	stats := &MovieStats{
+		Genres:        []GenreCount{},
+		Decades:       []DecadeCount{},
+		GenreRuntimes: []GenreRuntime{},
+		NewestAdded:   []*Movie{},
+	}
+
+	// total count
+	err = tx.QueryRowContext(ctx, `SELECT count(*) FROM movies WHERE `+statsFilter, args...).Scan(&stats.TotalMovies)
+	if err != nil {
+		return nil, err
+	}
+
+	// counts per genre, most popular first
+	query := `SELECT genre, count(*)
+	FROM movies, unnest(genres) AS genre
+	WHERE ` + statsFilter + `
+	GROUP BY genre
+	ORDER BY count(*) DESC, genre ASC`
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var gc GenreCount
+		if err := rows.Scan(&gc.Genre, &gc.Count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stats.Genres = append(stats.Genres, gc)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// counts per decade, oldest first
+	query = `SELECT (year / 10) * 10 AS decade, count(*)
+	FROM movies
+	WHERE ` + statsFilter + `
+	GROUP BY decade
+	ORDER BY decade ASC`
+
+	rows, err = tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var dc DecadeCount
+		if err := rows.Scan(&dc.Decade, &dc.Count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stats.Decades = append(stats.Decades, dc)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// average and percentile runtimes per genre
+	query = `SELECT genre,
+		avg(runtime)::float8,
+		percentile_cont(0.5) WITHIN GROUP (ORDER BY runtime),
+		percentile_cont(0.9) WITHIN GROUP (ORDER BY runtime),
+		percentile_cont(0.99) WITHIN GROUP (ORDER BY runtime)
+	FROM movies, unnest(genres) AS genre
+	WHERE ` + statsFilter + `
+	GROUP BY genre
+	ORDER BY genre ASC`
+
+	rows, err = tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var gr GenreRuntime
+		if err := rows.Scan(&gr.Genre, &gr.Average, &gr.P50, &gr.P90, &gr.P99); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stats.GenreRuntimes = append(stats.GenreRuntimes, gr)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// newest additions by created_at
+	query = `SELECT id, created_at, title, year, runtime, genres, version
+	FROM movies
+	WHERE ` + statsFilter + `
+	ORDER BY created_at DESC, id DESC
+	LIMIT $3`
+
+	rows, err = tx.QueryContext(ctx, query, title, pq.Array(genres), statsNewestLimit)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var movie Movie
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+		)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stats.NewestAdded = append(stats.NewestAdded, &movie)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	stats.GeneratedAt = time.Now().UTC()
+	return stats, nil
+}
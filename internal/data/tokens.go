@@ -6,8 +6,10 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/meistens/api_practice/internal/validator"
 )
 
@@ -16,8 +18,33 @@ const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
 	ScoprPassReset      = "password-reset"
+	ScopeEmailChange    = "email-change"
+	ScopeRefresh        = "refresh"
+	ScopeMFAPending     = "mfa-pending"
+	ScopeOAuth          = "oauth"
+	ScopeUnlock         = "unlock"
+	ScopeMagicLink      = "magic-link"
 )
 
+// returned when a refresh token which has already been rotated is
+// presented again, a sign that it has been stolen
+var ErrTokenReused = errors.New("token reused")
+
+// what Rotate actually returns on reuse, it matches ErrTokenReused with
+// errors.Is and says whose token family was revoked
+type TokenReusedError struct {
+	UserID   int64
+	FamilyID []byte
+}
+
+func (e *TokenReusedError) Error() string {
+	return ErrTokenReused.Error()
+}
+
+func (e *TokenReusedError) Is(target error) bool {
+	return target == ErrTokenReused
+}
+
 // define a token struct to hold the data for an individual token
 type Token struct {
 	Plaintext string    `json:"token"`
@@ -25,6 +52,13 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	// shared by a refresh token, its access token and every token rotated
+	// from them, nil for standalone tokens
+	FamilyID []byte `json:"-"`
+	// set for OAuth access tokens, which can only use the permissions in
+	// OAuthScopes on behalf of the client
+	OAuthClientID int64       `json:"-"`
+	OAuthScopes   Permissions `json:"-"`
 }
 
 // generate token function
@@ -61,20 +95,40 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 
 // define tokenModel struct
 type TokenModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Cache *AuthCache
 }
 
 // insert() adds the data for a specific token to the token table
 func (m TokenModel) Insert(token *Token) error {
-	query := `INSERT INTO tokens (hash, user_id, expiry, scope)
-	VALUES ($1, $2, $3, $4)`
-
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
-
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
+	return insertToken(ctx, m.DB, token)
+}
+
+// shared by Insert() and the token pair functions, which run it inside
+// a transaction
+func insertToken(ctx context.Context, db DBTX, token *Token) error {
+	query := `INSERT INTO tokens (hash, user_id, expiry, scope, family_id, oauth_client_id, oauth_scopes)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	// standalone tokens have no family, store NULL rather than an empty value
+	var familyID any
+	if token.FamilyID != nil {
+		familyID = token.FamilyID
+	}
+
+	// same for the oauth columns on non-oauth tokens
+	var clientID, scopes any
+	if token.OAuthClientID != 0 {
+		clientID = token.OAuthClientID
+		scopes = pq.Array([]string(token.OAuthScopes))
+	}
+
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, familyID, clientID, scopes}
+
+	_, err := db.ExecContext(ctx, query, args...)
 	return err
 }
 
@@ -88,6 +142,20 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// creates an OAuth access token for a user (or a client's service account)
+// limited to the given scopes
+func (m TokenModel) NewOAuth(userID int64, ttl time.Duration, clientID int64, scopes Permissions) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeOAuth)
+	if err != nil {
+		return nil, err
+	}
+	token.OAuthClientID = clientID
+	token.OAuthScopes = scopes
+
+	err = m.Insert(token)
+	return token, err
+}
+
 // delete tokens for specific user and scope
 func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	query := `DELETE FROM tokens
@@ -97,5 +165,226 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
-	return err
+	if err != nil {
+		return err
+	}
+
+	m.Cache.invalidateUsers(userID)
+	return nil
+}
+
+// token details which are safe to show the user, no hash or plaintext
+type TokenMetadata struct {
+	Scope  string    `json:"scope"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// list the unexpired tokens held by a user
+func (m TokenModel) GetAllForUser(userID int64) ([]*TokenMetadata, error) {
+	query := `SELECT scope, expiry
+	FROM tokens
+	WHERE user_id = $1 AND expiry > NOW()
+	ORDER BY expiry`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*TokenMetadata{}
+
+	for rows.Next() {
+		var token TokenMetadata
+
+		err := rows.Scan(&token.Scope, &token.Expiry)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, &token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// delete every token for a user, whatever the scope
+func (m TokenModel) DeleteAllScopesForUser(userID int64) error {
+	query := `DELETE FROM tokens
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	m.Cache.invalidateUsers(userID)
+	return nil
+}
+
+// delete up to limit expired tokens, returning how many were deleted
+// expired tokens can't be used, so the cache doesn't need to hear about it
+func (m TokenModel) DeleteExpired(limit int) (int64, error) {
+	query := `DELETE FROM tokens
+	WHERE hash IN (
+		SELECT hash FROM tokens
+		WHERE expiry < NOW()
+		LIMIT $1
+	)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// generate an access token (ScopeAuthentication) and a refresh token
+// (ScopeRefresh) in the given family, and insert both
+// with signedAccess the access token isn't inserted, the caller replaces
+// it with a signed one and only needs its user, expiry and family
+func insertTokenPair(ctx context.Context, db DBTX, userID int64, familyID []byte, accessTTL, refreshTTL time.Duration, signedAccess bool) (*Token, *Token, error) {
+	access, err := generateToken(userID, accessTTL, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh, err := generateToken(userID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	access.FamilyID = familyID
+	refresh.FamilyID = familyID
+
+	if !signedAccess {
+		err = insertToken(ctx, db, access)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	err = insertToken(ctx, db, refresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+// start a new token family (and session) for a user, returning a short-lived
+// access token and the long-lived refresh token which can be rotated for
+// new ones, signedAccess is passed on to insertTokenPair()
+func (m TokenModel) NewPair(userID int64, accessTTL, refreshTTL time.Duration, client SessionClient, signedAccess bool) (*Token, *Token, error) {
+	familyID := make([]byte, 16)
+	_, err := rand.Read(familyID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	access, refresh, err := insertTokenPair(ctx, tx, userID, familyID, accessTTL, refreshTTL, signedAccess)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = insertSession(ctx, tx, userID, familyID, client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, tx.Commit()
+}
+
+// exchange a refresh token for a new access/refresh pair in the same family
+// the old refresh token is kept but marked as used, so if it is ever
+// presented again the whole family is revoked and a *TokenReusedError
+// (matching ErrTokenReused) returned
+// an unknown or expired token returns ErrRecordNotFound
+func (m TokenModel) Rotate(refreshPlaintext string, accessTTL, refreshTTL time.Duration, signedAccess bool) (*Token, *Token, error) {
+	hash := sha256.Sum256([]byte(refreshPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	// lock the row so two concurrent refreshes with the same token can't
+	// both rotate it
+	query := `SELECT user_id, family_id, used_at
+	FROM tokens
+	WHERE hash = $1 AND scope = $2 AND expiry > $3
+	FOR UPDATE`
+
+	var (
+		userID   int64
+		familyID []byte
+		usedAt   sql.NullTime
+	)
+
+	err = tx.QueryRowContext(ctx, query, hash[:], ScopeRefresh, time.Now()).Scan(&userID, &familyID, &usedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	if usedAt.Valid {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family_id = $1`, familyID)
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM sessions WHERE family_id = $1`, familyID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, nil, err
+		}
+		m.Cache.invalidateUsers(userID)
+		return nil, nil, &TokenReusedError{UserID: userID, FamilyID: familyID}
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET used_at = NOW() WHERE hash = $1`, hash[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE sessions SET last_used_at = NOW() WHERE family_id = $1`, familyID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	access, refresh, err := insertTokenPair(ctx, tx, userID, familyID, accessTTL, refreshTTL, signedAccess)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, tx.Commit()
 }
@@ -0,0 +1,61 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenDeleteExpired(t *testing.T) {
+	db := newTestDB(t)
+	models := NewModels(db, nil)
+	user := newTestUser(t, models)
+
+	var expired []*Token
+	for range 5 {
+		token, err := models.Tokens.New(user.ID, -time.Hour, ScopeActivation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expired = append(expired, token)
+	}
+
+	live, err := models.Tokens.New(user.ID, time.Hour, ScopeActivation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// batches never go over the limit, and the last one comes up short
+	const limit = 2
+	for {
+		n, err := models.Tokens.DeleteExpired(limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > limit {
+			t.Fatalf("deleted %d tokens, limit %d", n, limit)
+		}
+		if n < limit {
+			break
+		}
+	}
+
+	exists := func(token *Token) bool {
+		t.Helper()
+
+		var found bool
+		err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM tokens WHERE hash = $1)`, token.Hash).Scan(&found)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+
+	for _, token := range expired {
+		if exists(token) {
+			t.Errorf("expired token %s still there", token.Plaintext)
+		}
+	}
+	if !exists(live) {
+		t.Error("unexpired token deleted")
+	}
+}
@@ -0,0 +1,299 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/meistens/api_practice/internal/validator"
+)
+
+// number of recovery codes handed out when 2FA is enabled
+const recoveryCodeCount = 10
+
+var (
+	// returned when enrolling a user who already has 2FA turned on
+	ErrTOTPEnabled = errors.New("totp already enabled")
+	// returned when a TOTP code for an already used time step is presented
+	ErrTOTPReplayed = errors.New("totp code already used")
+)
+
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) == 6, "code", "must be 6 digits long")
+}
+
+func ValidateRecoveryCode(v *validator.Validator, code string) {
+	v.Check(code != "", "recovery_code", "must be provided")
+	v.Check(len(normaliseRecoveryCode(code)) == 11, "recovery_code", "must be 11 bytes long")
+}
+
+// recovery codes are typed in by hand, so they're lower case and split in
+// two, e.g. abcde-fghij
+// case and surrounding spaces are ignored when they're checked
+func normaliseRecoveryCode(code string) string {
+	return strings.ToLower(strings.TrimSpace(code))
+}
+
+func hashRecoveryCode(code string) []byte {
+	hash := sha256.Sum256([]byte(normaliseRecoveryCode(code)))
+	return hash[:]
+}
+
+// generate a fresh set of recovery codes, returning the plaintexts
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		// 50 bits, 10 base32 characters
+		randomBytes := make([]byte, 7)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(randomBytes))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// define TOTPModel type
+type TOTPModel struct {
+	DB    *sql.DB
+	Cache *AuthCache
+}
+
+// store a new secret for a user who hasn't enabled 2FA yet, replacing any
+// earlier unconfirmed one
+func (m TOTPModel) SetPendingSecret(userID int64, secret []byte) error {
+	query := `UPDATE users
+	SET totp_secret = $1, totp_last_step = NULL
+	WHERE id = $2 AND NOT totp_enabled`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, secret, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrTOTPEnabled
+	}
+	return nil
+}
+
+// retrieve a user's secret, confirmed or not
+func (m TOTPModel) GetSecret(userID int64) ([]byte, error) {
+	query := `SELECT totp_secret
+	FROM users
+	WHERE id = $1 AND totp_secret IS NOT NULL`
+
+	var secret []byte
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return secret, nil
+}
+
+// record the time step of an accepted code, so the same code can't be used
+// again while it is still valid
+// returns ErrTOTPReplayed if the step (or a later one) has been used already
+func (m TOTPModel) UseStep(userID int64, step int64) error {
+	query := `UPDATE users
+	SET totp_last_step = $1
+	WHERE id = $2 AND (totp_last_step IS NULL OR totp_last_step < $1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, step, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrTOTPReplayed
+	}
+	return nil
+}
+
+// turn 2FA on once the user has confirmed a code, returning their recovery
+// codes
+func (m TOTPModel) Enable(userID int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	query := `UPDATE users
+	SET totp_enabled = true, version = version + 1
+	WHERE id = $1 AND totp_secret IS NOT NULL`
+
+	_, err = tx.ExecContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	m.Cache.invalidateUsers(userID)
+	return codes, nil
+}
+
+// turn 2FA off, removing the secret and any unused recovery codes
+func (m TOTPModel) Disable(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE users
+	SET totp_secret = NULL, totp_enabled = false, totp_last_step = NULL, version = version + 1
+	WHERE id = $1`
+
+	_, err = tx.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	m.Cache.invalidateUsers(userID)
+	return nil
+}
+
+// throw away a user's recovery codes and generate new ones
+func (m TOTPModel) NewRecoveryCodes(userID int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func replaceRecoveryCodes(ctx context.Context, db DBTX, userID int64) ([]string, error) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([][]byte, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+
+	_, err = db.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `INSERT INTO recovery_codes (user_id, hash)
+	SELECT $1, unnest($2::bytea[])`
+
+	_, err = db.ExecContext(ctx, query, userID, pq.Array(hashes))
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// use up one of a user's recovery codes, returns ErrRecordNotFound if it
+// doesn't match any unused code
+func (m TOTPModel) UseRecoveryCode(userID int64, code string) error {
+	query := `DELETE FROM recovery_codes
+	WHERE user_id = $1 AND hash = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// number of unused recovery codes a user has left
+func (m TOTPModel) CountRecoveryCodes(userID int64) (int, error) {
+	query := `SELECT count(*)
+	FROM recovery_codes
+	WHERE user_id = $1`
+
+	var count int
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&count)
+	return count, err
+}
@@ -9,8 +9,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/meistens/api_practice/internal/validator"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // custom errduplicateemail error
@@ -20,7 +20,8 @@ var (
 
 // userModel struct which wraps the conn. pool
 type UserModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Cache *AuthCache
 }
 
 var AnonUser = &User{}
@@ -33,6 +34,17 @@ type User struct {
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
 	Version   int       `json:"-"`
+	// set when the user has asked for their account to be deleted, the
+	// account is purged once this time has passed
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+	// service accounts can't log in with a password, they authenticate
+	// with API keys
+	ServiceAccount bool `json:"service_account,omitempty"`
+	// set once a TOTP authenticator has been enrolled and confirmed, login
+	// then needs a code as well as the password
+	TwoFactorEnabled bool `json:"two_factor_enabled"`
+	// set while an admin has suspended the account
+	SuspendedAt *time.Time `json:"suspended_at,omitempty"`
 }
 
 // password type struct
@@ -49,33 +61,9 @@ func (u *User) IsAnon() bool {
 	return u == AnonUser
 }
 
-// set() calculates bcrypt hash of plaintext password
-// stores both hash and plaintext in struct
-func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
-	if err != nil {
-		return err
-	}
-	p.plaintext = &plaintextPassword
-	p.hash = hash
-
-	return nil
-}
-
-// matches() method checks if the provided plaintext matches the
-// hashed password stored in the struct, returning true if it
-// matches and false if it doesn't
-func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-	}
-	return true, nil
+// check if the account is suspended
+func (u *User) IsSuspended() bool {
+	return u.SuspendedAt != nil
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -86,7 +74,7 @@ func ValidateEmail(v *validator.Validator, email string) {
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	v.Check(len(password) <= 256, "password", "must not be more than 256 bytes long")
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
@@ -111,20 +99,47 @@ func ValidateUser(v *validator.Validator, user *User) {
 	}
 }
 
-// insert new user record to db
-func (m UserModel) Insert(user *User) error {
-	query := `INSERT INTO users (name, email, password_hash, activated)
-	VALUES ($1, $2, $3, $4)
-	RETURNING id, created_at, version`
-
-	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
-
+// insert new user record to db, along with the roles they start with
+// both happen in one transaction, so a user never exists without their
+// roles
+func (m UserModel) Insert(user *User, roleIDs ...int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	err = insertUser(ctx, tx, user)
+	if err != nil {
+		return err
+	}
+
+	for _, roleID := range roleIDs {
+		err = addUserRole(ctx, tx, user.ID, roleID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// shared by Insert() and OAuthModel.NewClient(), which inserts a client's
+// service account along with the client
+func insertUser(ctx context.Context, db DBTX, user *User) error {
+	query := `INSERT INTO users (name, email, password_hash, activated, service_account)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING id, created_at, version`
+
+	args := []any{user.Name, user.Email, user.Password.hash, user.Activated, user.ServiceAccount}
+
 	// if table already contains a record with this email, and
 	// an insert is attempted, error but in a dignified manner
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err := db.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 
 		// Temporary debugging - remove this after fixing
@@ -143,7 +158,7 @@ func (m UserModel) Insert(user *User) error {
 
 // retrieve user details from db based on user email address
 func (m UserModel) GetByEmail(email string) (*User, error) {
-	query := `SELECT id, created_at, name, email, password_hash, activated, version
+	query := `SELECT id, created_at, name, email, password_hash, activated, version, deletion_scheduled_at, service_account, totp_enabled, suspended_at
 	FROM users
 	WHERE email = $1`
 
@@ -160,6 +175,10 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.DeletionScheduledAt,
+		&user.ServiceAccount,
+		&user.TwoFactorEnabled,
+		&user.SuspendedAt,
 	)
 
 	if err != nil {
@@ -208,16 +227,28 @@ func (m UserModel) Update(user *User) error {
 			return err
 		}
 	}
+
+	m.Cache.invalidateUsers(user.ID)
 	return nil
 }
 
+// authentication tokens are looked up on every request, so they go
+// through the cache
 func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
 	// calc. hash of plaintext token provided by the client
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
+	cached := tokenScope == ScopeAuthentication
+	if cached {
+		if user, found := m.Cache.getUser(tokenHash); found {
+			return user, nil
+		}
+	}
+	generation := m.Cache.currentGeneration()
+
 	// setup query
 	query := `
-	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version, users.deletion_scheduled_at, users.service_account, users.totp_enabled, users.suspended_at, tokens.expiry
 	FROM users
 	INNER JOIN tokens
 	ON users.id = tokens.user_id
@@ -232,7 +263,10 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	// value to check against the token expiry.
 	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
 
-	var user User
+	var (
+		user   User
+		expiry time.Time
+	)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -247,6 +281,11 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.DeletionScheduledAt,
+		&user.ServiceAccount,
+		&user.TwoFactorEnabled,
+		&user.SuspendedAt,
+		&expiry,
 	)
 	if err != nil {
 		switch {
@@ -256,6 +295,375 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 			return nil, err
 		}
 	}
+
+	if cached {
+		m.Cache.setUser(tokenHash, &user, expiry, generation)
+	}
 	// return the matching user
 	return &user, nil
 }
+
+// like GetForToken(), but the token is deleted in the same statement so it
+// can only ever be used once, even by concurrent requests
+func (m UserModel) ConsumeToken(tokenScope, tokenPlaintext string) (*User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+	WITH token AS (
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+		RETURNING user_id
+	)
+	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version, users.deletion_scheduled_at, users.service_account, users.totp_enabled, users.suspended_at
+	FROM users
+	INNER JOIN token ON users.id = token.user_id`
+
+	args := []any{tokenHash[:], tokenScope, time.Now()}
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.DeletionScheduledAt,
+		&user.ServiceAccount,
+		&user.TwoFactorEnabled,
+		&user.SuspendedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// store an address the user wants to change to, pending confirmation
+func (m UserModel) SetPendingEmail(userID int64, email string) error {
+	query := `UPDATE users
+	SET pending_email = $1
+	WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email, userID)
+	return err
+}
+
+// swap the user's email for the pending one, checking the version as
+// update() does
+// returns ErrRecordNotFound if there's no pending address, and
+// ErrDuplicateEmail if another account took the address in the meantime
+func (m UserModel) ConfirmPendingEmail(user *User) error {
+	query := `UPDATE users
+	SET email = pending_email, pending_email = NULL, version = version + 1
+	WHERE id = $1 AND version = $2 AND pending_email IS NOT NULL
+	RETURNING email, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user.ID, user.Version).Scan(&user.Email, &user.Version)
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), "duplicate key value violates unique constraint") && strings.Contains(err.Error(), "email"):
+			return ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			// tell a missing pending address apart from a version change
+			var pending sql.NullString
+			err = m.DB.QueryRowContext(ctx, `SELECT pending_email FROM users WHERE id = $1`, user.ID).Scan(&pending)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			if !pending.Valid {
+				return ErrRecordNotFound
+			}
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	m.Cache.invalidateUsers(user.ID)
+	return nil
+}
+
+// drop a pending address, e.g after it lost a race to another account
+func (m UserModel) ClearPendingEmail(userID int64) error {
+	query := `UPDATE users
+	SET pending_email = NULL
+	WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// mark the user's account for deletion at the given time
+func (m UserModel) ScheduleDeletion(user *User, at time.Time) error {
+	query := `UPDATE users
+	SET deletion_scheduled_at = $1
+	WHERE id = $2
+	RETURNING deletion_scheduled_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, at, user.ID).Scan(&user.DeletionScheduledAt)
+	if err != nil {
+		return err
+	}
+
+	m.Cache.invalidateUsers(user.ID)
+	return nil
+}
+
+// clear a scheduled deletion
+func (m UserModel) CancelDeletion(user *User) error {
+	query := `UPDATE users
+	SET deletion_scheduled_at = NULL
+	WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, user.ID)
+	if err != nil {
+		return err
+	}
+	user.DeletionScheduledAt = nil
+
+	m.Cache.invalidateUsers(user.ID)
+	return nil
+}
+
+// suspend the user's account
+func (m UserModel) Suspend(user *User) error {
+	query := `UPDATE users
+	SET suspended_at = NOW()
+	WHERE id = $1
+	RETURNING suspended_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user.ID).Scan(&user.SuspendedAt)
+	if err != nil {
+		return err
+	}
+
+	m.Cache.invalidateUsers(user.ID)
+	return nil
+}
+
+// lift a suspension
+func (m UserModel) Unsuspend(user *User) error {
+	query := `UPDATE users
+	SET suspended_at = NULL
+	WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, user.ID)
+	if err != nil {
+		return err
+	}
+	user.SuspendedAt = nil
+
+	m.Cache.invalidateUsers(user.ID)
+	return nil
+}
+
+// list users for the admin API, search matches part of the name or email,
+// activated and suspended filter on those states when they aren't nil
+func (m UserModel) GetAll(search string, activated, suspended *bool, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`SELECT count(*) OVER(), id, created_at, name, email, activated, version, deletion_scheduled_at, service_account, totp_enabled, suspended_at
+	FROM users
+	WHERE (name ILIKE '%%' || $1 || '%%' OR email ILIKE '%%' || $1 || '%%' OR $1 = '')
+	AND (activated = $2 OR $2 IS NULL)
+	AND ((suspended_at IS NOT NULL) = $3 OR $3 IS NULL)
+	ORDER BY %s %s, id ASC
+	LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// % and _ in the search are matched literally
+	search = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(search)
+
+	args := []any{search, activated, suspended, filters.limit(), filters.offset()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.Version,
+			&user.DeletionScheduledAt,
+			&user.ServiceAccount,
+			&user.TwoFactorEnabled,
+			&user.SuspendedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return users, metadata, nil
+}
+
+// delete up to limit accounts whose scheduled deletion time has passed,
+// returning the IDs of the deleted users
+// movies they created or edited are kept but anonymised first, their login
+// attempts are deleted, and tokens and permissions go with the user
+// through ON DELETE CASCADE
+func (m UserModel) PurgeScheduled(limit int) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	// skip locked rows so several instances can run this at once
+	query := `SELECT id FROM users
+	WHERE deletion_scheduled_at <= NOW()
+	ORDER BY deletion_scheduled_at
+	LIMIT $1
+	FOR UPDATE SKIP LOCKED`
+
+	rows, err := tx.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	statements := []string{
+		`UPDATE movies SET created_by = NULL WHERE created_by = ANY($1)`,
+		`UPDATE movies SET updated_by = NULL WHERE updated_by = ANY($1)`,
+		`DELETE FROM idempotency_keys WHERE user_id = ANY($1)`,
+		// attempts keep the email address and IP, and ON DELETE SET NULL
+		// would only unlink them, so go by email too for the attempts made
+		// before the account existed
+		`DELETE FROM login_attempts WHERE user_id = ANY($1) OR email IN (SELECT email FROM users WHERE id = ANY($1))`,
+		// same for security events, which keep the IP and user agent and
+		// sometimes an email address, the ones recorded before the account
+		// existed have it in metadata, under any address it's had
+		`DELETE FROM security_events WHERE user_id = ANY($1) OR (user_id IS NULL AND lower(metadata->>'email') IN (
+			SELECT lower(email) FROM users WHERE id = ANY($1)
+			UNION
+			SELECT lower(metadata->>'previous_email') FROM security_events WHERE user_id = ANY($1) AND type = 'email_changed'
+		))`,
+		// what the account did to others stays in their history, without
+		// the account's IP and user agent
+		`UPDATE security_events SET ip = '', user_agent = '' WHERE actor_id = ANY($1)`,
+		`DELETE FROM users WHERE id = ANY($1)`,
+	}
+	for _, statement := range statements {
+		_, err = tx.ExecContext(ctx, statement, pq.Array(ids))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	m.Cache.invalidateUsers(ids...)
+	return ids, nil
+}
+
+// retrieve a user by ID
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT id, created_at, name, email, password_hash, activated, version, deletion_scheduled_at, service_account, totp_enabled, suspended_at
+	FROM users
+	WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.DeletionScheduledAt,
+		&user.ServiceAccount,
+		&user.TwoFactorEnabled,
+		&user.SuspendedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
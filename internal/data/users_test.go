@@ -0,0 +1,121 @@
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestUserPurgeScheduled(t *testing.T) {
+	db := newTestDB(t)
+	models := NewModels(db, nil)
+
+	due := newTestUser(t, models)
+	later := newTestUser(t, models)
+
+	err := models.Users.ScheduleDeletion(due, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = models.Users.ScheduleDeletion(later, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	movie := &Movie{Title: "Purge Test", Year: 2000, Runtime: 90, Genres: []string{"test"}, CreatedBy: due.ID}
+	err = models.Movies.Insert(movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(`DELETE FROM movies WHERE id = $1`, movie.ID) })
+
+	_, err = models.Tokens.New(due.ID, time.Hour, ScopeActivation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one attempt on the account, and one with its address from before it
+	// existed
+	for _, userID := range []int64{due.ID, 0} {
+		err = models.LoginAttempts.Insert(&LoginAttempt{UserID: userID, Email: due.Email, IP: "192.0.2.1", Outcome: LoginInvalidCredentials})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// events on the account, one it caused on another account, and one
+	// with its address from before it existed
+	events := []*SecurityEvent{
+		{Type: EventPasswordChanged, ActorID: due.ID, UserID: due.ID},
+		{Type: EventRoleAssigned, ActorID: due.ID, UserID: later.ID},
+		{Type: EventPasswordResetRequested, Metadata: map[string]string{"outcome": "unknown_email", "email": due.Email}},
+	}
+	for _, event := range events {
+		event.IP = "192.0.2.1"
+		event.UserAgent = "purge-test"
+		err = models.Events.Insert(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { db.Exec(`DELETE FROM security_events WHERE id = $1`, events[1].ID) })
+
+	purged := map[int64]bool{}
+	for {
+		ids, err := models.Users.PurgeScheduled(100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) == 0 {
+			break
+		}
+		for _, id := range ids {
+			purged[id] = true
+		}
+	}
+
+	if !purged[due.ID] || purged[later.ID] {
+		t.Fatalf("purged %v, want %d and not %d", purged, due.ID, later.ID)
+	}
+
+	_, err = models.Users.Get(due.ID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("purged user: got %v, want ErrRecordNotFound", err)
+	}
+	if _, err = models.Users.Get(later.ID); err != nil {
+		t.Errorf("user not due yet: %v", err)
+	}
+
+	count := func(query string, args ...any) int {
+		t.Helper()
+
+		var n int
+		if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	if n := count(`SELECT count(*) FROM tokens WHERE user_id = $1`, due.ID); n != 0 {
+		t.Errorf("%d tokens left", n)
+	}
+	if n := count(`SELECT count(*) FROM login_attempts WHERE email = $1`, due.Email); n != 0 {
+		t.Errorf("%d login attempts left", n)
+	}
+	if n := count(`SELECT count(*) FROM security_events WHERE id = ANY($1)`, pq.Array([]int64{events[0].ID, events[2].ID})); n != 0 {
+		t.Errorf("%d security events left", n)
+	}
+	if n := count(`SELECT count(*) FROM security_events WHERE id = $1 AND actor_id IS NULL AND ip = '' AND user_agent = ''`, events[1].ID); n != 1 {
+		t.Error("security event on another account not anonymised")
+	}
+
+	got, err := models.Movies.Get(movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CreatedBy != 0 || got.UpdatedBy != 0 {
+		t.Errorf("movie still owned: created_by %d, updated_by %d", got.CreatedBy, got.UpdatedBy)
+	}
+}
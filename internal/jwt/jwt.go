@@ -0,0 +1,240 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// supported signing algorithms, named as in the JWT "alg" header
+const (
+	AlgEdDSA = "EdDSA"
+	AlgHS256 = "HS256"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("expired token")
+	ErrUnknownKey   = errors.New("unknown signing key")
+)
+
+// base64url without padding, as used by every part of a JWT
+var b64 = base64.RawURLEncoding
+
+// a single signing key, identified by its key ID (the "kid" header)
+type Key struct {
+	ID         string
+	Alg        string
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+	secret     []byte
+}
+
+// parse a key from the "kid:alg:base64" format used by the
+// -auth-signing-keys flag
+// for EdDSA the key is the 32 byte ed25519 seed, for HS256 the secret,
+// which must be at least 32 bytes
+func ParseKey(spec string) (*Key, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, fmt.Errorf("signing key must be in the format kid:alg:base64key")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signing key %q: %w", parts[0], err)
+	}
+
+	key := &Key{ID: parts[0], Alg: parts[1]}
+
+	switch key.Alg {
+	case AlgEdDSA:
+		if len(raw) != ed25519.SeedSize {
+			return nil, fmt.Errorf("signing key %q: ed25519 seed must be %d bytes", key.ID, ed25519.SeedSize)
+		}
+		key.privateKey = ed25519.NewKeyFromSeed(raw)
+		key.publicKey = key.privateKey.Public().(ed25519.PublicKey)
+	case AlgHS256:
+		if len(raw) < 32 {
+			return nil, fmt.Errorf("signing key %q: hmac secret must be at least 32 bytes", key.ID)
+		}
+		key.secret = raw
+	default:
+		return nil, fmt.Errorf("signing key %q: unsupported algorithm %q", key.ID, key.Alg)
+	}
+	return key, nil
+}
+
+func (k *Key) sign(input []byte) []byte {
+	if k.Alg == AlgEdDSA {
+		return ed25519.Sign(k.privateKey, input)
+	}
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(input)
+	return mac.Sum(nil)
+}
+
+func (k *Key) verify(input, signature []byte) bool {
+	if k.Alg == AlgEdDSA {
+		return ed25519.Verify(k.publicKey, input, signature)
+	}
+	return hmac.Equal(k.sign(input), signature)
+}
+
+// a set of keys, the first one signs new tokens and all of them are used
+// to verify, so a retired key can stay in the set until the tokens it
+// signed have expired
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+}
+
+func NewKeySet(keys ...*Key) (*KeySet, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one signing key is required")
+	}
+
+	ks := &KeySet{signing: keys[0], keys: make(map[string]*Key)}
+	for _, key := range keys {
+		if _, exists := ks.keys[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate signing key id %q", key.ID)
+		}
+		ks.keys[key.ID] = key
+	}
+	return ks, nil
+}
+
+// claims carried by an access token
+type Claims struct {
+	Subject     int64    `json:"sub"`
+	IssuedAt    int64    `json:"iat"`
+	NotBefore   int64    `json:"nbf,omitempty"`
+	Expiry      int64    `json:"exp"`
+	ID          string   `json:"jti"`
+	Family      string   `json:"fam,omitempty"`
+	Activated   bool     `json:"act"`
+	MFA         bool     `json:"mfa,omitempty"`
+	Permissions []string `json:"perms"`
+}
+
+// token expiry as a time.Time
+func (c *Claims) ExpiresAt() time.Time {
+	return time.Unix(c.Expiry, 0)
+}
+
+// set the family claim from a token family ID
+func (c *Claims) SetFamily(familyID []byte) {
+	c.Family = hex.EncodeToString(familyID)
+}
+
+// the token family ID from the family claim, nil if there isn't one
+func (c *Claims) FamilyID() []byte {
+	familyID, err := hex.DecodeString(c.Family)
+	if err != nil || len(familyID) == 0 {
+		return nil
+	}
+	return familyID
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// sign the claims with the current signing key, filling in the ID and
+// issued-at claims if they aren't set
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	if claims.ID == "" {
+		id := make([]byte, 16)
+		_, err := rand.Read(id)
+		if err != nil {
+			return "", err
+		}
+		claims.ID = b64.EncodeToString(id)
+	}
+	if claims.IssuedAt == 0 {
+		claims.IssuedAt = time.Now().Unix()
+	}
+
+	h, err := json.Marshal(header{Alg: ks.signing.Alg, Typ: "JWT", Kid: ks.signing.ID})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := b64.EncodeToString(h) + "." + b64.EncodeToString(c)
+	return input + "." + b64.EncodeToString(ks.signing.sign([]byte(input))), nil
+}
+
+// check the signature and expiry of a token and return its claims
+func (ks *KeySet) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	rawHeader, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var h header
+	if err := json.Unmarshal(rawHeader, &h); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	key, found := ks.keys[h.Kid]
+	if !found {
+		return nil, ErrUnknownKey
+	}
+	// the algorithm comes from our key, never from the token, but a
+	// mismatch means the token wasn't signed by us
+	if h.Alg != key.Alg {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+
+	rawClaims, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if claims.ID == "" || claims.Subject < 1 {
+		return nil, ErrInvalidToken
+	}
+	if now.Unix() >= claims.Expiry {
+		return nil, ErrExpiredToken
+	}
+	if claims.NotBefore != 0 && now.Unix() < claims.NotBefore {
+		return nil, ErrInvalidToken
+	}
+	return &claims, nil
+}
+
+// check if a bearer token looks like a signed token rather than one of the
+// 26 character opaque tokens
+func LooksSigned(token string) bool {
+	return strings.Count(token, ".") == 2
+}
@@ -0,0 +1,276 @@
+package jwt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustParseKey(t *testing.T, kid, alg string, raw []byte) *Key {
+	t.Helper()
+
+	key, err := ParseKey(kid + ":" + alg + ":" + base64.StdEncoding.EncodeToString(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func mustKeySet(t *testing.T, keys ...*Key) *KeySet {
+	t.Helper()
+
+	ks, err := NewKeySet(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+// sign arbitrary header and claims with a key, for tokens Sign() would
+// never produce
+func forge(t *testing.T, key *Key, h header, claims Claims) string {
+	t.Helper()
+
+	rawHeader, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawClaims, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := b64.EncodeToString(rawHeader) + "." + b64.EncodeToString(rawClaims)
+	return input + "." + b64.EncodeToString(key.sign([]byte(input)))
+}
+
+func TestParseKey(t *testing.T) {
+	seed := strings.Repeat("s", 32)
+
+	tests := []struct {
+		name    string
+		spec    string
+		wantErr bool
+	}{
+		{"eddsa", "k1:EdDSA:" + base64.StdEncoding.EncodeToString([]byte(seed)), false},
+		{"hs256", "k1:HS256:" + base64.StdEncoding.EncodeToString([]byte(seed)), false},
+		{"missing parts", "k1:EdDSA", true},
+		{"missing kid", ":EdDSA:" + base64.StdEncoding.EncodeToString([]byte(seed)), true},
+		{"bad base64", "k1:EdDSA:!!!", true},
+		{"short seed", "k1:EdDSA:" + base64.StdEncoding.EncodeToString([]byte("short")), true},
+		{"short secret", "k1:HS256:" + base64.StdEncoding.EncodeToString([]byte("short")), true},
+		{"unknown alg", "k1:RS256:" + base64.StdEncoding.EncodeToString([]byte(seed)), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseKey(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewKeySet(t *testing.T) {
+	if _, err := NewKeySet(); err == nil {
+		t.Error("empty key set: want error")
+	}
+
+	a := mustParseKey(t, "a", AlgHS256, []byte(strings.Repeat("a", 32)))
+	b := mustParseKey(t, "a", AlgHS256, []byte(strings.Repeat("b", 32)))
+	if _, err := NewKeySet(a, b); err == nil {
+		t.Error("duplicate kid: want error")
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+
+	for _, alg := range []string{AlgEdDSA, AlgHS256} {
+		t.Run(alg, func(t *testing.T) {
+			ks := mustKeySet(t, mustParseKey(t, "k1", alg, []byte(strings.Repeat("k", 32))))
+
+			token, err := ks.Sign(Claims{
+				Subject:     42,
+				Expiry:      now.Add(time.Minute).Unix(),
+				Activated:   true,
+				Permissions: []string{"movies:read"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !LooksSigned(token) {
+				t.Fatalf("LooksSigned(%q) = false", token)
+			}
+
+			claims, err := ks.Verify(token, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != 42 || !claims.Activated || len(claims.Permissions) != 1 || claims.Permissions[0] != "movies:read" {
+				t.Errorf("claims not carried through: %+v", claims)
+			}
+			if claims.ID == "" || claims.IssuedAt == 0 {
+				t.Errorf("Sign didn't fill in jti and iat: %+v", claims)
+			}
+		})
+	}
+}
+
+func TestSignUsesFirstKeyAndVerifiesWithAny(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	current := mustParseKey(t, "current", AlgEdDSA, []byte(strings.Repeat("c", 32)))
+	retired := mustParseKey(t, "retired", AlgHS256, []byte(strings.Repeat("r", 32)))
+
+	// a token signed before the key was retired
+	old, err := mustKeySet(t, retired).Sign(Claims{Subject: 1, Expiry: now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks := mustKeySet(t, current, retired)
+
+	token, err := ks.Sign(Claims{Subject: 1, Expiry: now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rawHeader, _ := b64.DecodeString(strings.Split(token, ".")[0])
+	var h header
+	if err := json.Unmarshal(rawHeader, &h); err != nil {
+		t.Fatal(err)
+	}
+	if h.Kid != "current" || h.Alg != AlgEdDSA {
+		t.Errorf("signed with kid %q alg %q, want the first key", h.Kid, h.Alg)
+	}
+
+	for name, tok := range map[string]string{"current": token, "retired": old} {
+		if _, err := ks.Verify(tok, now); err != nil {
+			t.Errorf("%s key: %v", name, err)
+		}
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+
+	ed := mustParseKey(t, "ed", AlgEdDSA, []byte(strings.Repeat("e", 32)))
+	hs := mustParseKey(t, "hs", AlgHS256, []byte(strings.Repeat("h", 32)))
+	ks := mustKeySet(t, ed, hs)
+
+	// an HMAC key made from the ed25519 public key, what an attacker would
+	// sign with when trying alg confusion
+	confused := &Key{ID: "ed", Alg: AlgHS256, secret: ed.publicKey}
+	// a key we don't have, using a kid we do
+	stranger := mustParseKey(t, "hs", AlgHS256, []byte(strings.Repeat("x", 32)))
+
+	valid := Claims{Subject: 1, ID: "jti", IssuedAt: now.Unix(), Expiry: now.Add(time.Minute).Unix()}
+
+	good, err := ks.Sign(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(good, ".")
+
+	rawNone, _ := json.Marshal(header{Alg: "none", Typ: "JWT", Kid: "hs"})
+	noneHeader := b64.EncodeToString(rawNone)
+
+	tampered := valid
+	tampered.Subject = 2
+	rawTampered, _ := json.Marshal(tampered)
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"not three parts", "a.b", ErrInvalidToken},
+		{"bad header encoding", "!!!." + parts[1] + "." + parts[2], ErrInvalidToken},
+		{"bad signature encoding", parts[0] + "." + parts[1] + ".!!!", ErrInvalidToken},
+		{"tampered claims", parts[0] + "." + b64.EncodeToString(rawTampered) + "." + parts[2], ErrInvalidToken},
+		{"unknown kid", forge(t, hs, header{Alg: AlgHS256, Typ: "JWT", Kid: "nope"}, valid), ErrUnknownKey},
+		{"wrong key", forge(t, stranger, header{Alg: AlgHS256, Typ: "JWT", Kid: "hs"}, valid), ErrInvalidToken},
+		{"alg confusion", forge(t, confused, header{Alg: AlgHS256, Typ: "JWT", Kid: "ed"}, valid), ErrInvalidToken},
+		{"alg none", noneHeader + "." + parts[1] + ".", ErrInvalidToken},
+		{"alg swapped", forge(t, hs, header{Alg: AlgEdDSA, Typ: "JWT", Kid: "hs"}, valid), ErrInvalidToken},
+		{"missing jti", forge(t, hs, header{Alg: AlgHS256, Typ: "JWT", Kid: "hs"}, Claims{Subject: 1, Expiry: valid.Expiry}), ErrInvalidToken},
+		{"missing subject", forge(t, hs, header{Alg: AlgHS256, Typ: "JWT", Kid: "hs"}, Claims{ID: "jti", Expiry: valid.Expiry}), ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ks.Verify(tt.token, now)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyTimes(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	ks := mustKeySet(t, mustParseKey(t, "k1", AlgHS256, []byte(strings.Repeat("k", 32))))
+
+	tests := []struct {
+		name      string
+		expiry    time.Time
+		notBefore time.Time
+		want      error
+	}{
+		{"valid", now.Add(time.Second), time.Time{}, nil},
+		{"expires now", now, time.Time{}, ErrExpiredToken},
+		{"expired", now.Add(-time.Minute), time.Time{}, ErrExpiredToken},
+		{"not before passed", now.Add(time.Minute), now.Add(-time.Second), nil},
+		{"not before now", now.Add(time.Minute), now, nil},
+		{"not yet valid", now.Add(time.Minute), now.Add(time.Second), ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := Claims{Subject: 1, Expiry: tt.expiry.Unix()}
+			if !tt.notBefore.IsZero() {
+				claims.NotBefore = tt.notBefore.Unix()
+			}
+
+			token, err := ks.Sign(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = ks.Verify(token, now)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFamily(t *testing.T) {
+	var claims Claims
+	if claims.FamilyID() != nil {
+		t.Error("no family claim: want nil")
+	}
+
+	claims.SetFamily([]byte{0xde, 0xad, 0xbe, 0xef})
+	if got := claims.FamilyID(); string(got) != "\xde\xad\xbe\xef" {
+		t.Errorf("FamilyID() = %x", got)
+	}
+
+	claims.Family = "not hex"
+	if claims.FamilyID() != nil {
+		t.Error("bad family claim: want nil")
+	}
+}
+
+func TestLooksSigned(t *testing.T) {
+	if LooksSigned("ABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+		t.Error("opaque token looks signed")
+	}
+	if !LooksSigned("a.b.c") {
+		t.Error("three part token doesn't look signed")
+	}
+}
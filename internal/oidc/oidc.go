@@ -0,0 +1,389 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidIDToken = errors.New("invalid id token")
+	ErrExchangeFailed = errors.New("code exchange failed")
+)
+
+// JWKS isn't refetched more often than this when an unknown key ID turns
+// up, so forged tokens can't be used to hammer the provider
+const jwksMinRefresh = time.Minute
+
+// allowed clock skew when checking exp and iat
+const leeway = time.Minute
+
+// base64url without padding, as used by JWTs and JWKs
+var b64 = base64.RawURLEncoding
+
+// the parts of the discovery document we use
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Config holds the client registration with the provider
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+}
+
+// an OpenID Connect provider we log users in through
+type Provider struct {
+	config    Config
+	endpoints discovery
+	client    *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// claims we read from an ID token
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	Expiry        int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// aud can be a single string or an array
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*a = audience(many)
+	return nil
+}
+
+// fetch the provider's discovery document and signing keys
+func Discover(ctx context.Context, config Config) (*Provider, error) {
+	p := &Provider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	wellKnown := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+
+	err := p.getJSON(ctx, wellKnown, &p.endpoints)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+
+	// the document has to be for the issuer we were configured with,
+	// OpenID Connect Discovery section 4.3
+	if p.endpoints.Issuer != config.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q doesn't match %q", p.endpoints.Issuer, config.Issuer)
+	}
+	if p.endpoints.AuthorizationEndpoint == "" || p.endpoints.TokenEndpoint == "" || p.endpoints.JWKSURI == "" {
+		return nil, errors.New("oidc discovery: document is missing endpoints")
+	}
+
+	err = p.refreshKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, dest any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1_048_576)).Decode(dest)
+}
+
+// the URL to send the user's browser to, carrying the state, nonce and
+// PKCE challenge for this login
+func (p *Provider) AuthCodeURL(state, nonce, codeVerifier string) string {
+	challenge := sha256.Sum256([]byte(codeVerifier))
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.config.ClientID)
+	params.Set("redirect_uri", p.config.RedirectURI)
+	params.Set("scope", "openid email profile")
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", b64.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(p.endpoints.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.endpoints.AuthorizationEndpoint + separator + params.Encode()
+}
+
+// exchange an authorization code for an ID token and return its verified
+// claims, the nonce must be the one sent with AuthCodeURL()
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*Claims, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURI)
+	form.Set("code_verifier", codeVerifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoints.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	// a rejected code is the user's problem, not ours
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrExchangeFailed, res.Status)
+	}
+
+	var body struct {
+		IDToken string `json:"id_token"`
+	}
+	err = json.NewDecoder(io.LimitReader(res.Body, 1_048_576)).Decode(&body)
+	if err != nil {
+		return nil, err
+	}
+	if body.IDToken == "" {
+		return nil, fmt.Errorf("%w: no id_token in response", ErrExchangeFailed)
+	}
+
+	claims, err := p.verify(ctx, body.IDToken, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if claims.Nonce != nonce {
+		return nil, ErrInvalidIDToken
+	}
+	return claims, nil
+}
+
+// check an ID token's signature against the provider's keys and its
+// issuer, audience and lifetime
+func (p *Provider) verify(ctx context.Context, token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+
+	rawHeader, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	// the algorithm has to fit the key type, so "none" or an HMAC keyed
+	// with a public key never get this far
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) != nil {
+			return nil, ErrInvalidIDToken
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return nil, ErrInvalidIDToken
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return nil, ErrInvalidIDToken
+		}
+	default:
+		return nil, ErrInvalidIDToken
+	}
+
+	rawClaims, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	switch {
+	case claims.Issuer != p.config.Issuer,
+		!slices.Contains(claims.Audience, p.config.ClientID),
+		claims.Subject == "",
+		now.Add(-leeway).Unix() >= claims.Expiry,
+		claims.IssuedAt > now.Add(leeway).Unix():
+		return nil, ErrInvalidIDToken
+	}
+	return &claims, nil
+}
+
+// look up a signing key by ID, refetching the JWKS once if it's unknown
+// (the provider may have rotated its keys)
+func (p *Provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	key, found := p.lookup(kid)
+	stale := time.Since(p.fetchedAt) > jwksMinRefresh
+	p.mu.Unlock()
+
+	if found {
+		return key, nil
+	}
+	if !stale {
+		return nil, ErrInvalidIDToken
+	}
+
+	err := p.refreshKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, found = p.lookup(kid)
+	if !found {
+		return nil, ErrInvalidIDToken
+	}
+	return key, nil
+}
+
+// tokens without a kid are only accepted when there's a single key to
+// choose from, p.mu must be held
+func (p *Provider) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, found := p.keys[kid]
+	return key, found
+}
+
+func (p *Provider) refreshKeys(ctx context.Context) error {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+
+	err := p.getJSON(ctx, p.endpoints.JWKSURI, &jwks)
+	if err != nil {
+		return fmt.Errorf("oidc jwks: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		switch jwk.Kty {
+		case "RSA":
+			n, errN := b64.DecodeString(jwk.N)
+			e, errE := b64.DecodeString(jwk.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				continue
+			}
+			keys[jwk.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			if jwk.Crv != "P-256" {
+				continue
+			}
+			x, errX := b64.DecodeString(jwk.X)
+			y, errY := b64.DecodeString(jwk.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			key := &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+			keys[jwk.Kid] = key
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.keys = keys
+	p.fetchedAt = time.Now()
+	return nil
+}
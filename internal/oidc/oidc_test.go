@@ -0,0 +1,413 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "client"
+	testClientSecret = "secret"
+	testCode         = "code"
+	testVerifier     = "verifier"
+	testNonce        = "nonce"
+)
+
+// fakeProvider is an OpenID Connect provider serving discovery, a JWKS
+// with an RSA and an EC key, and a token endpoint handing out idToken
+type fakeProvider struct {
+	*httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu          sync.Mutex
+	idToken     string
+	jwks        []map[string]string
+	jwksFetches int
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeProvider{rsaKey: rsaKey, ecKey: ecKey}
+	f.jwks = []map[string]string{rsaJWK("rsa", &rsaKey.PublicKey), ecJWK("ec", &ecKey.PublicKey)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/authorize",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		f.jwksFetches++
+		json.NewEncoder(w).Encode(map[string]any{"keys": f.jwks})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != testClientID || secret != testClientSecret {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("code") != testCode || r.PostFormValue("code_verifier") != testVerifier {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		json.NewEncoder(w).Encode(map[string]string{"id_token": f.idToken})
+	})
+
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// how many times the JWKS has been fetched
+func (f *fakeProvider) fetches() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.jwksFetches
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   b64.EncodeToString(key.N.Bytes()),
+		"e":   b64.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   b64.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   b64.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// the claims of a token the provider would issue for this login
+func (f *fakeProvider) claims() map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":            f.URL,
+		"sub":            "248289761001",
+		"aud":            testClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          testNonce,
+		"email":          "jane@example.com",
+		"email_verified": true,
+		"name":           "Jane Doe",
+	}
+}
+
+// build a token with the header and claims, signed with key, which is an
+// *rsa.PrivateKey, an *ecdsa.PrivateKey or nil for no signature
+func sign(t *testing.T, header, claims map[string]any, key crypto.Signer) string {
+	t.Helper()
+
+	rawHeader, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawClaims, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingInput := b64.EncodeToString(rawHeader) + "." + b64.EncodeToString(rawClaims)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return signingInput + "." + b64.EncodeToString(signature)
+}
+
+func (f *fakeProvider) discover(t *testing.T) *Provider {
+	t.Helper()
+
+	p, err := Discover(context.Background(), Config{
+		Issuer:       f.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURI:  "https://app.example.com/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// hand out token from the token endpoint and exchange the code for it
+func (f *fakeProvider) exchange(t *testing.T, p *Provider, token string) (*Claims, error) {
+	t.Helper()
+
+	f.mu.Lock()
+	f.idToken = token
+	f.mu.Unlock()
+
+	return p.Exchange(context.Background(), testCode, testVerifier, testNonce)
+}
+
+func TestExchange(t *testing.T) {
+	f := newFakeProvider(t)
+	p := f.discover(t)
+
+	tests := []struct {
+		name   string
+		header map[string]any
+		key    crypto.Signer
+	}{
+		{"RS256", map[string]any{"alg": "RS256", "kid": "rsa"}, f.rsaKey},
+		{"ES256", map[string]any{"alg": "ES256", "kid": "ec"}, f.ecKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := f.exchange(t, p, sign(t, tt.header, f.claims(), tt.key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != "248289761001" || claims.Email != "jane@example.com" || !claims.EmailVerified || claims.Name != "Jane Doe" {
+				t.Errorf("got claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestExchangeInvalidIDToken(t *testing.T) {
+	f := newFakeProvider(t)
+	p := f.discover(t)
+
+	otherRSA, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherEC, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs256 := map[string]any{"alg": "RS256", "kid": "rsa"}
+	es256 := map[string]any{"alg": "ES256", "kid": "ec"}
+
+	// the provider's claims with one changed, or removed for nil
+	with := func(name string, value any) map[string]any {
+		claims := f.claims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"malformed", "not.a-token"},
+		{"two parts", strings.Join(strings.Split(sign(t, rs256, f.claims(), f.rsaKey), ".")[:2], ".")},
+		{"header not base64", "!!!." + strings.SplitN(sign(t, rs256, f.claims(), f.rsaKey), ".", 2)[1]},
+
+		{"RS256 signed by another key", sign(t, rs256, f.claims(), otherRSA)},
+		{"ES256 signed by another key", sign(t, es256, f.claims(), otherEC)},
+		{"unsigned", sign(t, rs256, f.claims(), nil)},
+		{"claims changed after signing", func() string {
+			parts := strings.Split(sign(t, rs256, f.claims(), f.rsaKey), ".")
+			other := strings.Split(sign(t, rs256, with("sub", "someone-else"), f.rsaKey), ".")
+			return parts[0] + "." + other[1] + "." + parts[2]
+		}()},
+
+		{"alg none", sign(t, map[string]any{"alg": "none", "kid": "rsa"}, f.claims(), nil)},
+		{"HS256 with an RSA key", sign(t, map[string]any{"alg": "HS256", "kid": "rsa"}, f.claims(), f.rsaKey)},
+		{"ES256 with an RSA key", sign(t, map[string]any{"alg": "ES256", "kid": "rsa"}, f.claims(), f.ecKey)},
+		{"RS256 with an EC key", sign(t, map[string]any{"alg": "RS256", "kid": "ec"}, f.claims(), f.rsaKey)},
+		{"RS384", sign(t, map[string]any{"alg": "RS384", "kid": "rsa"}, f.claims(), f.rsaKey)},
+		{"unknown kid", sign(t, map[string]any{"alg": "RS256", "kid": "other"}, f.claims(), f.rsaKey)},
+		{"no kid with two keys", sign(t, map[string]any{"alg": "RS256"}, f.claims(), f.rsaKey)},
+
+		{"other audience", sign(t, rs256, with("aud", "other-client"), f.rsaKey)},
+		{"other audiences", sign(t, rs256, with("aud", []string{"other-client", "another"}), f.rsaKey)},
+		{"no audience", sign(t, rs256, with("aud", nil), f.rsaKey)},
+		{"other issuer", sign(t, rs256, with("iss", "https://evil.example.com"), f.rsaKey)},
+		{"issuer with a trailing slash", sign(t, rs256, with("iss", f.URL+"/"), f.rsaKey)},
+		{"no issuer", sign(t, rs256, with("iss", nil), f.rsaKey)},
+		{"no subject", sign(t, rs256, with("sub", nil), f.rsaKey)},
+
+		{"expired", sign(t, rs256, with("exp", now.Add(-2*leeway).Unix()), f.rsaKey)},
+		{"expired at the edge of the leeway", sign(t, rs256, with("exp", now.Add(-leeway).Unix()), f.rsaKey)},
+		{"no expiry", sign(t, rs256, with("exp", nil), f.rsaKey)},
+		{"issued in the future", sign(t, rs256, with("iat", now.Add(2*leeway).Unix()), f.rsaKey)},
+
+		{"other nonce", sign(t, rs256, with("nonce", "other"), f.rsaKey)},
+		{"no nonce", sign(t, rs256, with("nonce", nil), f.rsaKey)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := f.exchange(t, p, tt.token)
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("got %+v, %v, want ErrInvalidIDToken", claims, err)
+			}
+		})
+	}
+}
+
+func TestExchangeLeeway(t *testing.T) {
+	f := newFakeProvider(t)
+	p := f.discover(t)
+
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		claims map[string]any
+	}{
+		{"expired within the leeway", map[string]any{"exp": now.Add(-leeway / 2).Unix()}},
+		{"issued slightly in the future", map[string]any{"iat": now.Add(leeway / 2).Unix()}},
+		{"audience list", map[string]any{"aud": []string{"other-client", testClientID}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := f.claims()
+			for name, value := range tt.claims {
+				claims[name] = value
+			}
+
+			_, err := f.exchange(t, p, sign(t, map[string]any{"alg": "RS256", "kid": "rsa"}, claims, f.rsaKey))
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestExchangeRejected(t *testing.T) {
+	f := newFakeProvider(t)
+	p := f.discover(t)
+
+	_, err := p.Exchange(context.Background(), "wrong-code", testVerifier, testNonce)
+	if !errors.Is(err, ErrExchangeFailed) {
+		t.Errorf("wrong code: got %v, want ErrExchangeFailed", err)
+	}
+
+	_, err = p.Exchange(context.Background(), testCode, "wrong-verifier", testNonce)
+	if !errors.Is(err, ErrExchangeFailed) {
+		t.Errorf("wrong verifier: got %v, want ErrExchangeFailed", err)
+	}
+
+	_, err = f.exchange(t, p, "")
+	if !errors.Is(err, ErrExchangeFailed) {
+		t.Errorf("no id_token: got %v, want ErrExchangeFailed", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	f := newFakeProvider(t)
+	p := f.discover(t)
+
+	rotated, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	f.jwks = []map[string]string{rsaJWK("rotated", &rotated.PublicKey)}
+	f.mu.Unlock()
+
+	token := sign(t, map[string]any{"alg": "RS256", "kid": "rotated"}, f.claims(), rotated)
+
+	// the keys were fetched just now, so an unknown kid doesn't refetch
+	// them yet
+	_, err = f.exchange(t, p, token)
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("before the refresh interval: got %v, want ErrInvalidIDToken", err)
+	}
+	if n := f.fetches(); n != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", n)
+	}
+
+	p.mu.Lock()
+	p.fetchedAt = time.Now().Add(-2 * jwksMinRefresh)
+	p.mu.Unlock()
+
+	_, err = f.exchange(t, p, token)
+	if err != nil {
+		t.Fatalf("after the refresh interval: %v", err)
+	}
+	if n := f.fetches(); n != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", n)
+	}
+
+	// the old keys are gone, and with a single key left a token without a
+	// kid can use it
+	_, err = f.exchange(t, p, sign(t, map[string]any{"alg": "RS256", "kid": "rsa"}, f.claims(), f.rsaKey))
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("old key: got %v, want ErrInvalidIDToken", err)
+	}
+	_, err = f.exchange(t, p, sign(t, map[string]any{"alg": "RS256"}, f.claims(), rotated))
+	if err != nil {
+		t.Errorf("no kid with one key: %v", err)
+	}
+}
+
+func TestDiscoverIssuerMismatch(t *testing.T) {
+	f := newFakeProvider(t)
+
+	_, err := Discover(context.Background(), Config{Issuer: f.URL + "/", ClientID: testClientID})
+	if err == nil {
+		t.Error("got no error for a discovery document with another issuer")
+	}
+}
@@ -0,0 +1,142 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// the SHA1 secret from RFC 6238 appendix B
+var rfcSecret = []byte("12345678901234567890")
+
+func TestCodeRFC6238(t *testing.T) {
+	// the appendix lists 8 digit codes, 6 digit ones are their last 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, tt := range tests {
+		step := Step(time.Unix(tt.unix, 0))
+		if got := Code(rfcSecret, step); got != tt.want[2:] {
+			t.Errorf("Code() at %d = %q, want %q", tt.unix, got, tt.want[2:])
+		}
+	}
+}
+
+func TestCodeRFC4226(t *testing.T) {
+	// HOTP values from RFC 4226 appendix D, TOTP is HOTP with the step as
+	// the counter
+	want := []string{
+		"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489",
+	}
+
+	for counter, code := range want {
+		if got := Code(rfcSecret, int64(counter)); got != code {
+			t.Errorf("Code() for counter %d = %q, want %q", counter, got, code)
+		}
+	}
+}
+
+func TestStep(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want int64
+	}{
+		{0, 0},
+		{29, 0},
+		{30, 1},
+		{59, 1},
+		{1111111109, 37037036},
+		{1111111111, 37037037},
+	}
+
+	for _, tt := range tests {
+		if got := Step(time.Unix(tt.unix, 0)); got != tt.want {
+			t.Errorf("Step(%d) = %d, want %d", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", Code(rfcSecret, current), current, true},
+		{"one step behind", Code(rfcSecret, current-1), current - 1, true},
+		{"one step ahead", Code(rfcSecret, current+1), current + 1, true},
+		{"two steps behind", Code(rfcSecret, current-2), 0, false},
+		{"two steps ahead", Code(rfcSecret, current+2), 0, false},
+		{"wrong code", "000000", 0, false},
+		{"too short", Code(rfcSecret, current)[:5], 0, false},
+		{"too long", Code(rfcSecret, current) + "0", 0, false},
+		{"empty", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := Validate(rfcSecret, tt.code, now)
+			if ok != tt.wantOK || step != tt.wantStep {
+				t.Fatalf("Validate(%q) = %d, %v, want %d, %v", tt.code, step, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestValidateSkewAtStepEdges(t *testing.T) {
+	// the first and last second of a step accept the same codes
+	start := time.Unix(30*1000, 0)
+	end := start.Add(Period - time.Second)
+
+	for _, step := range []int64{999, 1000, 1001} {
+		code := Code(rfcSecret, step)
+		for _, at := range []time.Time{start, end} {
+			if got, ok := Validate(rfcSecret, code, at); !ok || got != step {
+				t.Errorf("code for step %d at %d: got %d, %v", step, at.Unix(), got, ok)
+			}
+		}
+	}
+
+	// a second later the oldest one has gone and the next one is in
+	after := end.Add(time.Second)
+	if _, ok := Validate(rfcSecret, Code(rfcSecret, 999), after); ok {
+		t.Error("code two steps old accepted")
+	}
+	if _, ok := Validate(rfcSecret, Code(rfcSecret, 1002), after); !ok {
+		t.Error("code one step ahead rejected")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Greenlight", "alice@example.com", rfcSecret)
+
+	for _, part := range []string{
+		"otpauth://totp/Greenlight:alice@example.com?",
+		"secret=" + EncodeSecret(rfcSecret),
+		"issuer=Greenlight",
+		"digits=6",
+		"period=30",
+		"algorithm=SHA1",
+	} {
+		if !strings.Contains(uri, part) {
+			t.Errorf("URI() = %q, missing %q", uri, part)
+		}
+	}
+	if strings.Contains(EncodeSecret(rfcSecret), "=") {
+		t.Error("EncodeSecret() is padded")
+	}
+}
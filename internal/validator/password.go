@@ -0,0 +1,208 @@
+package validator
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy is the set of rules a new password has to pass, on top of
+// the basic length checks done wherever a password is read
+type PasswordPolicy struct {
+	// minimum length in characters, 0 for no minimum
+	MinLength int
+	// minimum estimated entropy in bits, 0 to skip the check
+	MinEntropy float64
+	// passwords known from data breaches, nil to skip the check
+	Breached *BreachedPasswords
+}
+
+// Validate checks a new password against the policy, adding a single error
+// under key which lists every rule it fails
+// personal is anything about the user the password mustn't contain, like
+// their name and email address
+// nothing is checked if key already has an error, so the basic length
+// checks should come first
+// the error returned is only for failing to read the breached passwords
+func (p *PasswordPolicy) Validate(v *Validator, key, password string, personal ...string) error {
+	if _, exists := v.Errors[key]; exists {
+		return nil
+	}
+
+	failures, err := p.Check(password, personal...)
+	if err != nil {
+		return err
+	}
+	if len(failures) > 0 {
+		v.AddError(key, strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Check returns a user-facing message for each rule the password fails
+func (p *PasswordPolicy) Check(password string, personal ...string) ([]string, error) {
+	var failures []string
+
+	if p.MinLength > 0 && utf8.RuneCountInString(password) < p.MinLength {
+		failures = append(failures, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+
+	if p.MinEntropy > 0 && PasswordEntropy(password) < p.MinEntropy {
+		failures = append(failures, "is too easy to guess, try a longer password or mix in other kinds of characters")
+	}
+
+	if containsPersonal(password, personal) {
+		failures = append(failures, "must not contain your name or email address")
+	}
+
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return nil, err
+		}
+		if breached {
+			failures = append(failures, "has appeared in a known data breach, please choose a different password")
+		}
+	}
+	return failures, nil
+}
+
+// PasswordEntropy estimates the strength of a password in bits, as its
+// length times the bits per character for the kinds of characters it uses
+// characters repeating the previous one, or continuing a run like "abc" or
+// "321", add nothing, so padding a weak password out doesn't help much
+func PasswordEntropy(password string) float64 {
+	var (
+		lower, upper, digit, symbol, other bool
+		effective                          int
+		prev                               rune = -1
+		step                               rune
+	)
+
+	for _, c := range password {
+		switch {
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= '0' && c <= '9':
+			digit = true
+		case c < utf8.RuneSelf && unicode.IsPrint(c):
+			symbol = true
+		default:
+			other = true
+		}
+
+		diff := c - prev
+		switch {
+		case prev >= 0 && diff == 0:
+			// repeated character
+		case prev >= 0 && (diff == 1 || diff == -1) && (step == 0 || step == diff):
+			// sequence, the first step is free too since "ab" is still a run
+			step = diff
+		default:
+			effective++
+			step = 0
+		}
+		prev = c
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	return float64(effective) * math.Log2(float64(pool))
+}
+
+// check if the password contains any of the personal values, or the
+// parts of them (words of a name, the local part of an email address)
+// long enough to matter
+func containsPersonal(password string, personal []string) bool {
+	lowered := strings.ToLower(password)
+
+	for _, value := range personal {
+		value = strings.ToLower(value)
+		// the domain isn't personal, and "com" would rule out "welcome"
+		if at := strings.LastIndex(value, "@"); at >= 0 {
+			value = value[:at]
+		}
+
+		parts := strings.FieldsFunc(value, func(c rune) bool {
+			return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+		})
+		parts = append(parts, value)
+
+		for _, part := range parts {
+			if utf8.RuneCountInString(part) >= 3 && strings.Contains(lowered, part) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// BreachedPasswords is a local copy of a breached password corpus in the
+// Have I Been Pwned range format, a directory of files named after the
+// first 5 hex characters of a SHA-1 hash (e.g. 21BD1.txt), each holding
+// the remaining 35 characters of every hash with that prefix as
+// SUFFIX:COUNT lines
+// only the one file for a password's prefix is read to check it
+type BreachedPasswords struct {
+	dir string
+}
+
+// OpenBreachedPasswords uses the corpus in dir, which has to exist
+func OpenBreachedPasswords(dir string) (*BreachedPasswords, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("breached passwords: %s is not a directory", dir)
+	}
+	return &BreachedPasswords{dir: dir}, nil
+}
+
+// Contains reports whether the password appears in the corpus, a missing
+// range file means none of its hashes are known
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(b.dir, prefix+".txt"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// padding entries added by the range API have a count of 0
+		hashSuffix, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(hashSuffix, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
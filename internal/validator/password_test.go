@@ -0,0 +1,245 @@
+package validator
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPasswordEntropy(t *testing.T) {
+	bits := func(effective int, pool float64) float64 {
+		return float64(effective) * math.Log2(pool)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		want     float64
+	}{
+		{"empty", "", 0},
+		{"one character", "a", bits(1, 26)},
+		{"lowercase", "qzmvk", bits(5, 26)},
+		{"uppercase", "QZMVK", bits(5, 26)},
+		{"digits", "9270", bits(4, 10)},
+		{"symbols", "#!%", bits(3, 33)},
+		{"lower and upper", "qZmVk", bits(5, 52)},
+		{"every ascii class", "qZ9#", bits(4, 95)},
+		{"non-ascii", "qé", bits(2, 126)},
+
+		{"repeats add nothing", "aaaaaaaa", bits(1, 26)},
+		{"ascending run adds nothing", "abcdefgh", bits(1, 26)},
+		{"descending run adds nothing", "87654321", bits(1, 10)},
+		{"two characters are a run", "ab", bits(1, 26)},
+		{"run changing direction", "abcba", bits(2, 26)},
+		{"runs repeated", "abcabcabc", bits(3, 26)},
+		{"run broken by a repeat", "abbc", bits(1, 26)},
+		{"steps of two aren't a run", "acegi", bits(5, 26)},
+		{"run across classes", "9:;", bits(1, 43)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := PasswordEntropy(tt.password)
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("PasswordEntropy(%q) = %.2f, want %.2f", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyEntropy(t *testing.T) {
+	// the default -password-min-entropy
+	policy := &PasswordPolicy{MinEntropy: 40}
+
+	tests := []struct {
+		password string
+		pass     bool
+	}{
+		{"password", false},
+		{"abc123", false},
+		{"abcdefghijklmnopqrstuvwxyz", false},
+		{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", false},
+		{"12345678901234567890", false},
+		{"Tr0ub4dor&3", true},
+		{"correct horse battery staple", true},
+		{"qzmvkwjtxp", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			failures, err := policy.Check(tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pass := len(failures) == 0; pass != tt.pass {
+				t.Errorf("%q at %.1f bits: pass = %t, want %t (%v)", tt.password, PasswordEntropy(tt.password), pass, tt.pass, failures)
+			}
+		})
+	}
+}
+
+func TestContainsPersonal(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		personal []string
+		want     bool
+	}{
+		{"nothing personal", "Tr0ub4dor&3", []string{"Jane Doe", "jane.doe@example.com"}, false},
+		{"no personal values", "jane", nil, false},
+		{"empty personal value", "jane", []string{""}, false},
+
+		{"whole name", "xxjanedoexx", []string{"janedoe"}, true},
+		{"first name", "ilovejane1", []string{"Jane Doe"}, true},
+		{"last name", "doe12345", []string{"Jane Doe"}, true},
+		{"name with its space", "my jane doe", []string{"Jane Doe"}, true},
+		{"case insensitive password", "ILOVEJANE", []string{"Jane Doe"}, true},
+		{"case insensitive name", "ilovejane", []string{"JANE DOE"}, true},
+		{"non-ascii case", "ÉLODIE99", []string{"élodie"}, true},
+
+		{"email local part", "janedoe77", []string{"janedoe@example.com"}, true},
+		{"email local part pieces", "doe-rocks", []string{"jane.doe@example.com"}, true},
+		{"email domain", "welcome-example", []string{"jane.doe@example.com"}, false},
+		{"email tld", "welcome1", []string{"jane.doe@example.com"}, false},
+
+		{"short tokens don't count", "alligator", []string{"Al Li"}, false},
+		{"two character name", "ed2024ed", []string{"Ed"}, false},
+		{"three characters count", "xxbobxx", []string{"Bob"}, true},
+		{"short tokens together", "al li", []string{"Al Li"}, true},
+		{"digits in a name", "pass007word", []string{"agent 007"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := containsPersonal(tt.password, tt.personal); got != tt.want {
+				t.Errorf("containsPersonal(%q, %q) = %t, want %t", tt.password, tt.personal, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreachedPasswords(t *testing.T) {
+	dir := t.TempDir()
+
+	// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8 and
+	// of "hunter2" F3BBBD66A63D4BF1747940578EC3D0103530E21D
+	files := map[string]string{
+		"5BAA6.txt": "0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n" +
+			"1E4C9B93F3F0682250B6CF8331B7EE68FD8:9659365\r\n",
+		// lowercase, and a padding entry for the suffix
+		"F3BBB.txt": "0018a45c4d1def81644b54ab7f969b88d65:3\n" +
+			"d66a63d4bf1747940578ec3d0103530e21d:0\n",
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	breached, err := OpenBreachedPasswords(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		want     bool
+	}{
+		{"listed", "password", true},
+		{"padding entry", "hunter2", false},
+		{"other suffix in the range", "Password", false},
+		{"no range file", "Tr0ub4dor&3", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := breached.Contains(tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Contains(%q) = %t, want %t", tt.password, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("lowercase range file", func(t *testing.T) {
+		err := os.WriteFile(filepath.Join(dir, "F3BBB.txt"), []byte("d66a63d4bf1747940578ec3d0103530e21d:17\n"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := breached.Contains("hunter2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got {
+			t.Error("Contains(\"hunter2\") = false, want true")
+		}
+	})
+
+	t.Run("policy", func(t *testing.T) {
+		policy := &PasswordPolicy{Breached: breached}
+
+		v := New()
+		err := policy.Validate(v, "password", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(v.Errors["password"], "data breach") {
+			t.Errorf("got errors %v, want a data breach error", v.Errors)
+		}
+	})
+}
+
+func TestOpenBreachedPasswords(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := OpenBreachedPasswords(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing directory: got no error")
+	}
+
+	file := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenBreachedPasswords(file); err == nil {
+		t.Error("file instead of a directory: got no error")
+	}
+}
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 8, MinEntropy: 40}
+
+	v := New()
+	if err := policy.Validate(v, "password", "janedoe", "Jane Doe"); err != nil {
+		t.Fatal(err)
+	}
+	// every failure in one message
+	for _, want := range []string{"at least 8 characters", "too easy to guess", "your name or email address"} {
+		if !strings.Contains(v.Errors["password"], want) {
+			t.Errorf("got %q, want it to contain %q", v.Errors["password"], want)
+		}
+	}
+
+	// an earlier error under the key is left alone
+	v = New()
+	v.AddError("password", "must be provided")
+	if err := policy.Validate(v, "password", "a", "Jane Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if v.Errors["password"] != "must be provided" {
+		t.Errorf("got %q, want the earlier error", v.Errors["password"])
+	}
+
+	v = New()
+	if err := policy.Validate(v, "password", "Tr0ub4dor&3", "Jane Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if !v.Valid() {
+		t.Errorf("got errors %v for a good password", v.Errors)
+	}
+}
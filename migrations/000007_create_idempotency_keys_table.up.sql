@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key text NOT NULL,
+    user_id bigint NOT NULL DEFAULT 0,
+    request_hash bytea NOT NULL,
+    status_code integer,
+    headers jsonb,
+    body bytea,
+    created_at timestamp(0)
+    with
+        time zone NOT NULL DEFAULT NOW (),
+        expiry timestamp(0)
+    with
+        time zone NOT NULL,
+        PRIMARY KEY (key, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expiry_idx ON idempotency_keys (expiry);
@@ -0,0 +1,13 @@
+ALTER TABLE movies
+ADD COLUMN IF NOT EXISTS created_by bigint REFERENCES users ON DELETE SET NULL;
+
+ALTER TABLE movies
+ADD COLUMN IF NOT EXISTS updated_by bigint REFERENCES users ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS movies_created_by_idx ON movies (created_by);
+
+-- write access limited to movies the user created
+INSERT INTO
+    permissions (code)
+VALUES
+    ('movies:write:own');
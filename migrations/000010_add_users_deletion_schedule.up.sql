@@ -0,0 +1,6 @@
+ALTER TABLE users
+ADD COLUMN IF NOT EXISTS deletion_scheduled_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS users_deletion_scheduled_at_idx ON users (deletion_scheduled_at)
+WHERE
+    deletion_scheduled_at IS NOT NULL;
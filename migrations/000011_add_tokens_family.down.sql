@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS tokens_family_id_idx;
+
+ALTER TABLE tokens
+DROP COLUMN IF EXISTS used_at;
+
+ALTER TABLE tokens
+DROP COLUMN IF EXISTS family_id;
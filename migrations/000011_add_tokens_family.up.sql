@@ -0,0 +1,11 @@
+-- refresh tokens and the access tokens issued with them share a family,
+-- used_at marks a refresh token which has already been rotated
+ALTER TABLE tokens
+ADD COLUMN IF NOT EXISTS family_id bytea;
+
+ALTER TABLE tokens
+ADD COLUMN IF NOT EXISTS used_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS tokens_family_id_idx ON tokens (family_id)
+WHERE
+    family_id IS NOT NULL;
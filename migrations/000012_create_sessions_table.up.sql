@@ -0,0 +1,16 @@
+-- one row per login, tying together the token family issued for it
+CREATE TABLE IF NOT EXISTS sessions (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    family_id bytea UNIQUE NOT NULL,
+    created_at timestamp(0)
+    with
+        time zone NOT NULL DEFAULT NOW (),
+        last_used_at timestamp(0)
+    with
+        time zone NOT NULL DEFAULT NOW (),
+        ip text NOT NULL DEFAULT '',
+        user_agent text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
@@ -0,0 +1,12 @@
+-- signed access tokens revoked before their expiry, by token ID (jti)
+CREATE TABLE IF NOT EXISTS token_denylist (
+    jti text PRIMARY KEY,
+    expiry timestamp(0)
+    with
+        time zone NOT NULL,
+        created_at timestamp(0)
+    with
+        time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS token_denylist_expiry_idx ON token_denylist (expiry);
@@ -0,0 +1,8 @@
+DELETE FROM permissions
+WHERE
+    code = 'api_keys:admin';
+
+DROP TABLE IF EXISTS api_keys;
+
+ALTER TABLE users
+DROP COLUMN IF EXISTS service_account;
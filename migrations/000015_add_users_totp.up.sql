@@ -0,0 +1,17 @@
+-- totp_secret is set on enrolment, totp_enabled once a code has been
+-- confirmed, totp_last_step stops a code being used twice
+ALTER TABLE users
+ADD COLUMN IF NOT EXISTS totp_secret bytea,
+ADD COLUMN IF NOT EXISTS totp_enabled bool NOT NULL DEFAULT false,
+ADD COLUMN IF NOT EXISTS totp_last_step bigint;
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    hash bytea NOT NULL,
+    created_at timestamp(0)
+    with
+        time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS recovery_codes_user_id_idx ON recovery_codes (user_id);
@@ -0,0 +1,11 @@
+DELETE FROM permissions
+WHERE
+    code = 'oauth_clients:admin';
+
+ALTER TABLE tokens
+DROP COLUMN IF EXISTS oauth_scopes,
+DROP COLUMN IF EXISTS oauth_client_id;
+
+DROP TABLE IF EXISTS oauth_codes;
+
+DROP TABLE IF EXISTS oauth_clients;
@@ -0,0 +1,39 @@
+-- third-party applications, public clients have no secret and can only use
+-- the authorization code grant with PKCE
+-- confidential clients get a service account (user_id) which the client
+-- credentials grant issues tokens for
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id bigserial PRIMARY KEY,
+    client_id text UNIQUE NOT NULL,
+    secret_hash bytea,
+    name text NOT NULL,
+    redirect_uris text[] NOT NULL,
+    scopes text[] NOT NULL,
+    user_id bigint REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(0)
+    with
+        time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE TABLE IF NOT EXISTS oauth_codes (
+    hash bytea PRIMARY KEY,
+    client_id bigint NOT NULL REFERENCES oauth_clients ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    redirect_uri text NOT NULL,
+    scopes text[] NOT NULL,
+    code_challenge text NOT NULL,
+    expiry timestamp(0)
+    with
+        time zone NOT NULL
+);
+
+-- oauth access tokens are limited to the scopes the user consented to
+ALTER TABLE tokens
+ADD COLUMN IF NOT EXISTS oauth_client_id bigint REFERENCES oauth_clients ON DELETE CASCADE,
+ADD COLUMN IF NOT EXISTS oauth_scopes text[];
+
+-- register and remove oauth clients
+INSERT INTO
+    permissions (code)
+VALUES
+    ('oauth_clients:admin');
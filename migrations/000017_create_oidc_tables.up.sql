@@ -0,0 +1,22 @@
+-- logins started with the external provider, waiting for its callback
+CREATE TABLE IF NOT EXISTS oidc_logins (
+    state_hash bytea PRIMARY KEY,
+    nonce text NOT NULL,
+    code_verifier text NOT NULL,
+    expiry timestamp(0)
+    with
+        time zone NOT NULL
+);
+
+-- accounts at external providers linked to users
+CREATE TABLE IF NOT EXISTS user_identities (
+    issuer text NOT NULL,
+    subject text NOT NULL,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(0)
+    with
+        time zone NOT NULL DEFAULT NOW (),
+        PRIMARY KEY (issuer, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
@@ -0,0 +1,7 @@
+DELETE FROM permissions
+WHERE
+    code = 'users:admin';
+
+DROP TABLE IF EXISTS login_lockouts;
+
+DROP TABLE IF EXISTS login_attempts;
@@ -0,0 +1,34 @@
+-- every login attempt, for auditing and per-IP backoff
+-- user_id is NULL when the email didn't match an account
+CREATE TABLE IF NOT EXISTS login_attempts (
+    id bigserial PRIMARY KEY,
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    email citext NOT NULL,
+    ip text NOT NULL,
+    outcome text NOT NULL,
+    created_at timestamp(0)
+    with
+        time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS login_attempts_ip_idx ON login_attempts (ip, created_at);
+
+CREATE INDEX IF NOT EXISTS login_attempts_user_id_idx ON login_attempts (user_id, created_at);
+
+-- failures since the last successful login, and how long the account is
+-- locked for
+CREATE TABLE IF NOT EXISTS login_lockouts (
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    failures integer NOT NULL DEFAULT 0,
+    locked_until timestamp(0)
+    with
+        time zone
+);
+
+-- manage other users' accounts, needed here for unlocking accounts and
+-- listing their login attempts, the admin user management API added with
+-- users.suspended_at uses the same permission
+INSERT INTO
+    permissions (code)
+VALUES
+    ('users:admin');
@@ -0,0 +1,8 @@
+-- set while an admin has suspended the account, it can't log in or use
+-- any credentials until it's lifted
+-- suspending is done by admins holding users:admin, which is seeded in
+-- 000018 along with the login attempts
+ALTER TABLE users
+ADD COLUMN IF NOT EXISTS suspended_at timestamp(0)
+with
+    time zone;
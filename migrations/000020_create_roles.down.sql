@@ -0,0 +1,9 @@
+DELETE FROM permissions
+WHERE
+    code = 'roles:admin';
+
+DROP TABLE IF EXISTS user_roles;
+
+DROP TABLE IF EXISTS roles_permissions;
+
+DROP TABLE IF EXISTS roles;
@@ -0,0 +1,55 @@
+-- roles bundle permission codes, users get the union of their own
+-- permissions and those of their roles
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    name citext UNIQUE NOT NULL,
+    description text NOT NULL DEFAULT '',
+    created_at timestamp(0)
+    with
+        time zone NOT NULL DEFAULT NOW (),
+        version integer NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+-- manage roles themselves
+INSERT INTO
+    permissions (code)
+VALUES
+    ('roles:admin');
+
+INSERT INTO
+    roles (name, description)
+VALUES
+    ('viewer', 'Read the movie catalogue'),
+    ('editor', 'Read and edit the movie catalogue'),
+    ('admin', 'Everything');
+
+INSERT INTO
+    roles_permissions
+SELECT
+    roles.id,
+    permissions.id
+FROM
+    roles,
+    permissions
+WHERE
+    (
+        roles.name = 'viewer'
+        AND permissions.code = 'movies:read'
+    )
+    OR (
+        roles.name = 'editor'
+        AND permissions.code IN ('movies:read', 'movies:write')
+    )
+    OR roles.name = 'admin';
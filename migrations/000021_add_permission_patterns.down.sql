@@ -0,0 +1,28 @@
+DELETE FROM users_permissions
+WHERE
+    deny;
+
+DELETE FROM roles_permissions
+WHERE
+    deny;
+
+DELETE FROM permissions
+WHERE
+    code IN ('*', 'movies:*', '*:read', '*:admin');
+
+INSERT INTO
+    roles_permissions (role_id, permission_id)
+SELECT
+    roles.id,
+    permissions.id
+FROM
+    roles,
+    permissions
+WHERE
+    roles.name = 'admin' ON CONFLICT DO NOTHING;
+
+ALTER TABLE users_permissions
+DROP COLUMN IF EXISTS deny;
+
+ALTER TABLE roles_permissions
+DROP COLUMN IF EXISTS deny;
@@ -0,0 +1,34 @@
+-- a grant can deny a permission instead, which wins over any allow
+ALTER TABLE users_permissions
+ADD COLUMN IF NOT EXISTS deny bool NOT NULL DEFAULT false;
+
+ALTER TABLE roles_permissions
+ADD COLUMN IF NOT EXISTS deny bool NOT NULL DEFAULT false;
+
+-- wildcard codes, * matches any one part of a code, or everything below it
+-- when it comes last
+INSERT INTO
+    permissions (code)
+VALUES
+    ('*'),
+    ('movies:*'),
+    ('*:read'),
+    ('*:admin');
+
+-- the admin role covers permissions added later on too
+DELETE FROM roles_permissions USING roles
+WHERE
+    roles_permissions.role_id = roles.id
+    AND roles.name = 'admin';
+
+INSERT INTO
+    roles_permissions (role_id, permission_id)
+SELECT
+    roles.id,
+    permissions.id
+FROM
+    roles,
+    permissions
+WHERE
+    roles.name = 'admin'
+    AND permissions.code = '*';
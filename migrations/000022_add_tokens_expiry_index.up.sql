@@ -0,0 +1,2 @@
+-- the token reaper looks for expired tokens
+CREATE INDEX IF NOT EXISTS tokens_expiry_idx ON tokens (expiry);
@@ -0,0 +1,20 @@
+-- audit log of logins, password changes, permission changes and token
+-- revocations, actor_id is NULL when nobody was logged in
+CREATE TABLE IF NOT EXISTS security_events (
+    id bigserial PRIMARY KEY,
+    type text NOT NULL,
+    actor_id bigint REFERENCES users ON DELETE SET NULL,
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    ip text NOT NULL,
+    user_agent text NOT NULL,
+    metadata jsonb NOT NULL DEFAULT '{}',
+    created_at timestamp(0)
+    with
+        time zone NOT NULL DEFAULT NOW ()
+);
+
+CREATE INDEX IF NOT EXISTS security_events_user_id_idx ON security_events (user_id, created_at);
+
+CREATE INDEX IF NOT EXISTS security_events_actor_id_idx ON security_events (actor_id, created_at);
+
+CREATE INDEX IF NOT EXISTS security_events_created_at_idx ON security_events (created_at);
@@ -0,0 +1,8 @@
+-- signed access tokens issued to a user at or before revoked_at are
+-- revoked, user_id 0 applies to every user
+CREATE TABLE IF NOT EXISTS token_denylist_users (
+    user_id bigint PRIMARY KEY,
+    revoked_at timestamp
+    with
+        time zone NOT NULL DEFAULT NOW ()
+);